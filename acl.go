@@ -0,0 +1,45 @@
+package localstar
+
+// Access control for clients of localstar.
+
+import (
+	"errors"
+	"net"
+)
+
+var errACLDenied = errors.New("denied by acl")
+
+type aclRule struct {
+	allow  bool
+	qtypes map[uint16]bool // empty matches any type
+	nets   []*net.IPNet    // empty matches any client
+}
+
+// clientACL is an ordered list of rules, the first matching rule decides.
+// Requests not matching any rule are denied if there is an allow rule, as
+// such a list names who may use localstar, and allowed otherwise.
+type clientACL struct {
+	rules []aclRule
+	drop  bool // drop denied requests silently instead of REFUSED
+}
+
+func (r aclRule) matches(ip net.IP, qtype uint16) bool {
+	if len(r.qtypes) > 0 && !r.qtypes[qtype] {
+		return false
+	}
+	return len(r.nets) == 0 || containsIP(r.nets, ip)
+}
+
+func (a *clientACL) allowed(ip net.IP, qtype uint16) bool {
+	for _, r := range a.rules {
+		if r.matches(ip, qtype) {
+			return r.allow
+		}
+	}
+	for _, r := range a.rules {
+		if r.allow {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package localstar
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type ACLTestSuite struct {
+	suite.Suite
+}
+
+func TestACLTestSuite(t *testing.T) {
+	suite.Run(t, new(ACLTestSuite))
+}
+
+func (s *ACLTestSuite) Test_allowed() {
+	office, _ := parseNets([]string{"10.1.0.0/16"})
+	vpn, _ := parseNets([]string{"10.8.0.0/16", "fd00:8::/32"})
+	acl := &clientACL{rules: []aclRule{
+		{allow: false, qtypes: map[uint16]bool{dns.TypeANY: true}},
+		{allow: true, nets: office},
+		{allow: true, qtypes: map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true}, nets: vpn},
+		{allow: false},
+	}}
+
+	for _, t := range []struct {
+		ip string
+		qtype uint16
+		allowed bool
+	}{
+		{"10.1.1.1", dns.TypeA, true},
+		{"10.1.1.1", dns.TypeMX, true},
+		{"10.1.1.1", dns.TypeANY, false},
+		{"10.8.1.1", dns.TypeA, true},
+		{"fd00:8::1", dns.TypeAAAA, true},
+		{"10.8.1.1", dns.TypeMX, false},
+		{"10.9.1.1", dns.TypeA, false},
+		{"8.8.8.8", dns.TypeA, false},
+	}{
+		s.Equal(t.allowed, acl.allowed(net.ParseIP(t.ip), t.qtype), t)
+	}
+
+	s.True((&clientACL{}).allowed(net.ParseIP("8.8.8.8"), dns.TypeA))
+	s.True((&clientACL{rules: []aclRule{{allow: false, nets: office}}}).allowed(net.ParseIP("8.8.8.8"), dns.TypeA))
+
+	// a list of allowed clients denies everyone else
+	allowOnly := &clientACL{rules: []aclRule{{allow: true, nets: office}}}
+	s.True(allowOnly.allowed(net.ParseIP("10.1.1.1"), dns.TypeA))
+	s.False(allowOnly.allowed(net.ParseIP("8.8.8.8"), dns.TypeA))
+	s.False(allowOnly.allowed(net.ParseIP("fd00:8::1"), dns.TypeA))
+}
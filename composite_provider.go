@@ -0,0 +1,187 @@
+package localstar
+
+// Provider dispatching queries to endpoints by their scheme.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	errUnsupportedScheme = errors.New("unsupported endpoint scheme")
+	errTsigTransport     = errors.New("tsig is not supported for the transport")
+)
+
+// providerOptions are options shared by providers of all endpoints.
+type providerOptions struct {
+	tsig      *tsigKey
+	tlsConfig *tls.Config
+}
+
+// providers are constructors of single endpoint providers by scheme.
+var providers = map[string]func(addr string, timeout time.Duration, opts providerOptions) (endpointProvider, error){
+	"dns": func (addr string, timeout time.Duration, opts providerOptions) (endpointProvider, error) {
+		return &simpleDNSProvider{addr: addr, timeout: timeout, tsig: opts.tsig}, nil
+	},
+	"tls": func (addr string, timeout time.Duration, opts providerOptions) (endpointProvider, error) {
+		// a connection is made per query, sessions are resumed to skip
+		// full handshakes
+		tlsConfig := opts.tlsConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		}
+		if tlsConfig.ClientSessionCache == nil {
+			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+		return &simpleDNSProvider{addr: addr, timeout: timeout, net: "tcp-tls", tlsConfig: tlsConfig, tsig: opts.tsig}, nil
+	},
+	"https": func (addr string, timeout time.Duration, opts providerOptions) (endpointProvider, error) {
+		if opts.tsig != nil {
+			return nil, errTsigTransport
+		}
+		return newHTTPSDNSProvider(addr, timeout, opts.tlsConfig), nil
+	},
+	"grpc": func (addr string, timeout time.Duration, opts providerOptions) (endpointProvider, error) {
+		if opts.tsig != nil {
+			return nil, errTsigTransport
+		}
+		return newGRPCDNSProvider(addr, timeout, opts.tlsConfig), nil
+	},
+}
+
+// splitEndpoint returns scheme and address of the endpoint, endpoints
+// without scheme are plain DNS.
+func splitEndpoint(endpoint string) (string, string) {
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		return endpoint[:i], endpoint[i+3:]
+	}
+	return "dns", endpoint
+}
+
+// compositeDNSProvider builds a provider for every endpoint according to
+// its scheme and tries them in order, unhealthy endpoints are skipped.
+type compositeDNSProvider struct {
+	opts      providerOptions
+	check     healthCheck
+	hedge     hedgePolicy
+	retry     retryPolicy
+	limit     *concurrencyLimit // of in-flight exchanges with endpoints
+	matchCase bool // case of question names must be preserved (DNS 0x20)
+	endpoints []string
+	timeout   time.Duration
+	providers []endpointProvider
+	health    []*endpointHealth
+	done      chan struct{} // stops health checks
+	latencies *latencyWindow // for percentile hedge delay
+}
+
+func (p *compositeDNSProvider) Init(endpoints []string, timeout time.Duration) error {
+	p.endpoints = append([]string{}, endpoints...)
+	p.timeout = timeout
+	if p.retry.attemptTimeout > 0 {
+		timeout = p.retry.attemptTimeout
+	}
+	p.providers = nil
+	p.health = nil
+	if p.hedge.percentile > 0 {
+		p.latencies = new(latencyWindow)
+	}
+	for _, endpoint := range endpoints {
+		scheme, addr := splitEndpoint(endpoint)
+		newProvider, ok := providers[scheme]
+		if !ok {
+			p.stop()
+			return fmt.Errorf("%w: %s", errUnsupportedScheme, endpoint)
+		}
+		provider, err := newProvider(addr, timeout, p.opts)
+		if err != nil {
+			p.stop()
+			return fmt.Errorf("%s: %w", endpoint, err)
+		}
+		p.providers = append(p.providers, provider)
+		p.health = append(p.health, new(endpointHealth))
+		if p.check.interval > 0 {
+			EndpointHealthyGauge.WithLabelValues(endpoint).Set(1)
+		}
+	}
+	return nil
+}
+
+// Exchange tries endpoints in order until one of them returns a valid response,
+// the whole pass is retried if attempts are configured. The total time is
+// bounded by timeout.
+func (p *compositeDNSProvider) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	if p.retry.attempts > 1 {
+		return p.exchangeRetry(ctx, msg)
+	}
+	return p.exchangeOnce(ctx, p.healthyProviders(), msg)
+}
+
+// exchangeOnce tries providers in order until one of them returns a valid
+// response, slow ones are raced with next ones if hedging is enabled.
+func (p *compositeDNSProvider) exchangeOnce(ctx context.Context, providers []endpointProvider, msg *dns.Msg) (*dns.Msg, error) {
+	if p.hedge.enabled() && len(providers) > 1 {
+		return p.exchangeHedged(ctx, providers, msg)
+	}
+	var err error
+	for _, provider := range providers {
+		var res *dns.Msg
+		if res, err = p.exchangeEndpoint(ctx, provider, msg); err == nil {
+			if err = validateResponse(msg, res, p.matchCase); err == nil {
+				return res, nil
+			}
+		}
+		// no slot is not a failure of the endpoint
+		if ctx.Err() != nil || err == errMaxConcurrent {
+			break
+		}
+	}
+	return nil, err
+}
+
+// start implements runnable, it starts providers of endpoints and health
+// checks if enabled.
+func (p *compositeDNSProvider) start() error {
+	for _, provider := range p.providers {
+		if r, ok := provider.(runnable); ok {
+			if err := r.start(); err != nil {
+				p.stop()
+				return err
+			}
+		}
+	}
+	if p.check.interval > 0 && p.done == nil {
+		p.done = make(chan struct{})
+		go p.runHealthCheck(p.done)
+	}
+	return nil
+}
+
+// stop implements runnable, it stops health checks and releases resources
+// of providers.
+func (p *compositeDNSProvider) stop() error {
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+	var err error
+	for _, provider := range p.providers {
+		if r, ok := provider.(runnable); ok {
+			if e := r.stop(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
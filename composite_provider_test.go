@@ -0,0 +1,171 @@
+package localstar
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type CompositeDNSProviderTestSuite struct {
+	suite.Suite
+}
+
+func TestCompositeDNSProviderTestSuite(t *testing.T) {
+	suite.Run(t, new(CompositeDNSProviderTestSuite))
+}
+
+func (s *CompositeDNSProviderTestSuite) Test_splitEndpoint() {
+	for endpoint, expected := range map[string][2]string{
+		"1.2.3.4:53":          {"dns", "1.2.3.4:53"},
+		"dns://1.2.3.4:1053":  {"dns", "1.2.3.4:1053"},
+		"tls://1.2.3.4:853":   {"tls", "1.2.3.4:853"},
+		"https://1.2.3.4:443": {"https", "1.2.3.4:443"},
+		"grpc://[::1]:443":    {"grpc", "[::1]:443"},
+	}{
+		scheme, addr := splitEndpoint(endpoint)
+		s.Equal(expected, [2]string{scheme, addr}, endpoint)
+	}
+}
+
+func (s *CompositeDNSProviderTestSuite) Test_Init() {
+	p := new(compositeDNSProvider)
+	err := p.Init([]string{
+		"1.2.3.4:53", "dns://1.2.3.4:1053", "tls://1.2.3.4:853", "https://1.2.3.4:443", "grpc://1.2.3.4:443",
+	}, time.Second)
+	if s.NoError(err) && s.Len(p.providers, 5) {
+		for i, addr := range []string{"1.2.3.4:53", "1.2.3.4:1053", "1.2.3.4:853"} {
+			if simple, ok := p.providers[i].(*simpleDNSProvider); s.True(ok) {
+				s.Equal(addr, simple.addr)
+				s.Equal(time.Second, simple.timeout)
+			}
+		}
+		s.Equal("", p.providers[0].(*simpleDNSProvider).net)
+		s.Equal("tcp-tls", p.providers[2].(*simpleDNSProvider).net)
+		s.NotNil(p.providers[2].(*simpleDNSProvider).tlsConfig.ClientSessionCache)
+		if https, ok := p.providers[3].(*httpsDNSProvider); s.True(ok) {
+			s.Equal("1.2.3.4:443", https.addr)
+		}
+		if grpc, ok := p.providers[4].(*grpcDNSProvider); s.True(ok) {
+			s.Equal("1.2.3.4:443", grpc.addr)
+		}
+	}
+	s.NoError(p.stop())
+
+	err = new(compositeDNSProvider).Init([]string{"1.2.3.4:53", "quic://1.2.3.4:853"}, time.Second)
+	s.ErrorIs(err, errUnsupportedScheme)
+
+	key := tsigKey{"key1.", dns.HmacSHA256, "c2VjcmV0"}
+	p = &compositeDNSProvider{opts: providerOptions{tsig: &key}}
+	if s.NoError(p.Init([]string{"1.2.3.4:53", "tls://1.2.3.4:853"}, time.Second)) {
+		s.Equal(&key, p.providers[0].(*simpleDNSProvider).tsig)
+		s.Equal(&key, p.providers[1].(*simpleDNSProvider).tsig)
+	}
+	for _, endpoint := range []string{"https://1.2.3.4:443", "grpc://1.2.3.4:443"} {
+		err = p.Init([]string{endpoint}, time.Second)
+		s.ErrorIs(err, errTsigTransport, endpoint)
+	}
+}
+
+func (s *CompositeDNSProviderTestSuite) Test_exchange() {
+	svc := &dnsService{handle: func (req *dns.Msg) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		return res
+	}}
+	addr, stop := startGRPCServer(s.T(), svc)
+	defer stop()
+
+	// the first endpoint never answers
+	dropping := startFakeServer(s.T())
+	dropping.setFaults(fakeFaults{drop: true})
+	p := &compositeDNSProvider{retry: retryPolicy{attempts: 1, attemptTimeout: 40 * time.Millisecond}}
+	s.Require().NoError(p.Init([]string{dropping.addr, "grpc://" + addr}, 100 * time.Millisecond))
+	s.Require().NoError(p.start())
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	res, err := p.Exchange(context.Background(), msg)
+	s.NoError(err)
+	s.NotNil(res)
+	s.Equal(1, dropping.calls())
+	s.EqualValues(1, atomic.LoadInt32(&svc.calls))
+
+	// providers are stopped along with the composite one
+	s.NoError(p.stop())
+	_, err = p.providers[1].Exchange(context.Background(), msg)
+	s.Equal(codes.Canceled, status.Code(err))
+}
+
+func (s *CompositeDNSProviderTestSuite) Test_exchange_failover() {
+	bad := &fakeServer{handler: func (w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Question[0].Name = "other.corp.net."
+		w.WriteMsg(res)
+	}}
+	bad.start(s.T())
+	good := startFakeServer(s.T(), "host1.corp.net. 60 IN A 10.1.1.1")
+	badAddr, goodAddr := bad.addr, good.addr
+
+	exchange := func (endpoints ...string) (*dns.Msg, error) {
+		p := new(compositeDNSProvider)
+		s.Require().NoError(p.Init(endpoints, 1 * time.Second))
+		msg := new(dns.Msg)
+		msg.SetQuestion("host1.corp.net.", dns.TypeA)
+		return p.Exchange(context.Background(), msg)
+	}
+
+	res, err := exchange(badAddr)
+	s.Nil(res)
+	s.ErrorIs(err, errInvalidResponse)
+	s.Equal(1, bad.calls())
+
+	res, err = exchange(badAddr, goodAddr)
+	if s.NoError(err) && s.NotNil(res) && s.Len(res.Answer, 1) {
+		s.Equal("10.1.1.1", res.Answer[0].(*dns.A).A.String())
+	}
+	s.Equal(2, bad.calls())
+	s.Equal(1, good.calls())
+
+	res, err = exchange(goodAddr, badAddr)
+	s.NoError(err)
+	s.NotNil(res)
+	s.Equal(2, bad.calls())
+	s.Equal(2, good.calls())
+}
+
+func (s *CompositeDNSProviderTestSuite) Test_exchange_matchCase() {
+	var calls []string
+	reply := func (name string, lower bool) *stubDNSProvider {
+		return &stubDNSProvider{exchangeCb: func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+			calls = append(calls, name)
+			res := new(dns.Msg)
+			res.SetReply(msg)
+			if lower {
+				res.Question[0].Name = strings.ToLower(res.Question[0].Name)
+			}
+			return res, nil
+		}}
+	}
+	p := &compositeDNSProvider{matchCase: true}
+	p.providers = []endpointProvider{reply("lower", true), reply("echo", false)}
+	msg := new(dns.Msg)
+	msg.SetQuestion("hOsT1.CoRp.NeT.", dns.TypeA)
+	res, err := p.Exchange(context.Background(), msg)
+	if s.NoError(err) {
+		s.Equal("hOsT1.CoRp.NeT.", res.Question[0].Name)
+	}
+	s.Equal([]string{"lower", "echo"}, calls)
+
+	calls = nil
+	p.matchCase = false
+	_, err = p.Exchange(context.Background(), msg)
+	s.NoError(err)
+	s.Equal([]string{"lower"}, calls)
+}
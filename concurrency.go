@@ -0,0 +1,69 @@
+package localstar
+
+// Limit of concurrent upstream exchanges.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+)
+
+var errMaxConcurrent = errors.New("max concurrent upstream exchanges exceeded")
+
+// concurrencyLimit bounds the number of in-flight upstream exchanges,
+// every query sent to an endpoint takes a slot, so hedged and retried
+// queries take several.
+type concurrencyLimit struct {
+	slots chan struct{}
+	wait  time.Duration // how long to wait for a free slot
+}
+
+func newConcurrencyLimit(max int, wait time.Duration) *concurrencyLimit {
+	return &concurrencyLimit{slots: make(chan struct{}, max), wait: wait}
+}
+
+// acquire takes a slot, it returns false if there is no free slot
+// within the wait time or ctx is done.
+func (c *concurrencyLimit) acquire(ctx context.Context) bool {
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if c.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(c.wait)
+	defer timer.Stop()
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *concurrencyLimit) release() {
+	<-c.slots
+}
+
+// exchangeEndpoint sends msg to a single endpoint within the concurrency
+// limit, every upstream exchange goes through it.
+func (p *compositeDNSProvider) exchangeEndpoint(ctx context.Context, provider endpointProvider, msg *dns.Msg) (*dns.Msg, error) {
+	server := metrics.WithServer(ctx)
+	if p.limit != nil {
+		if !p.limit.acquire(ctx) {
+			MaxConcurrentRejectCount.WithLabelValues(server).Inc()
+			return nil, errMaxConcurrent
+		}
+		defer p.limit.release()
+	}
+	InFlightGauge.WithLabelValues(server).Inc()
+	defer InFlightGauge.WithLabelValues(server).Dec()
+	return provider.Exchange(ctx, msg)
+}
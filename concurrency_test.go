@@ -0,0 +1,119 @@
+package localstar
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConcurrencyTestSuite struct {
+	suite.Suite
+}
+
+func TestConcurrencyTestSuite(t *testing.T) {
+	suite.Run(t, new(ConcurrencyTestSuite))
+}
+
+func (s *ConcurrencyTestSuite) Test_acquire() {
+	ctx := context.Background()
+	c := newConcurrencyLimit(2, 0)
+	s.True(c.acquire(ctx))
+	s.True(c.acquire(ctx))
+	s.False(c.acquire(ctx))
+	c.release()
+	s.True(c.acquire(ctx))
+}
+
+func (s *ConcurrencyTestSuite) Test_acquire_wait() {
+	ctx := context.Background()
+	c := newConcurrencyLimit(1, 50*time.Millisecond)
+	s.True(c.acquire(ctx))
+
+	start := time.Now()
+	s.False(c.acquire(ctx))
+	s.InDelta(50*time.Millisecond, time.Since(start), float64(20*time.Millisecond))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.release()
+	}()
+	s.True(c.acquire(ctx))
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	start = time.Now()
+	s.False(c.acquire(ctx))
+	s.Less(int64(time.Since(start)), int64(20*time.Millisecond))
+}
+
+func (s *ConcurrencyTestSuite) Test_exchange() {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	blocking := &stubDNSProvider{exchangeCb: func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		started <- struct{}{}
+		<-release
+		res := new(dns.Msg)
+		res.SetReply(msg)
+		return res, nil
+	}}
+	p := &compositeDNSProvider{limit: newConcurrencyLimit(2, 0)}
+	p.providers = []endpointProvider{blocking}
+	exchange := func () error {
+		msg := new(dns.Msg)
+		msg.SetQuestion("test.corp.net.", dns.TypeA)
+		_, err := p.Exchange(context.Background(), msg)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.NoError(exchange())
+		}()
+	}
+	<-started
+	<-started
+	s.ErrorIs(exchange(), errMaxConcurrent)
+	close(release)
+	wg.Wait()
+	s.NoError(exchange())
+}
+
+func (s *ConcurrencyTestSuite) Test_exchange_hedged() {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	blocking := &stubDNSProvider{exchangeCb: func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		res := new(dns.Msg)
+		res.SetReply(msg)
+		return res, nil
+	}}
+	// a hedged query takes a slot for every endpoint it is sent to
+	p := &compositeDNSProvider{limit: newConcurrencyLimit(2, 0), hedge: hedgePolicy{delay: 10 * time.Millisecond}}
+	p.providers = []endpointProvider{blocking, blocking}
+	exchange := func () error {
+		msg := new(dns.Msg)
+		msg.SetQuestion("test.corp.net.", dns.TypeA)
+		_, err := p.Exchange(context.Background(), msg)
+		return err
+	}
+
+	done := make(chan error)
+	go func() { done <- exchange() }()
+	<-started
+	<-started
+	s.ErrorIs(exchange(), errMaxConcurrent)
+	close(release)
+	s.NoError(<-done)
+}
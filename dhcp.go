@@ -0,0 +1,192 @@
+package localstar
+
+// DHCP lease files as a source of addresses.
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dhcpdTimeLayout = "2006/01/02 15:04:05"
+
+// leaseParsers are parsers of supported lease file formats.
+var leaseParsers = map[string]func(io.Reader, time.Time) (hostsMap, leaseEnds, error){
+	"dnsmasq": parseDnsmasqLeases,
+	"dhcpd":   parseDhcpdLeases,
+}
+
+// leaseEnds maps addresses to expiry times of their leases, addresses
+// with infinite leases are not in the map.
+type leaseEnds map[string]time.Time
+
+// leaseFile is a hostSource backed by a DHCP lease file. Hostnames from
+// leases are relative to the zone. The file is rewritten by DHCP servers
+// only from time to time, so expiry is checked on every lookup.
+type leaseFile struct {
+	*watchedFile
+	zone string
+	now  func() time.Time
+
+	mu   sync.RWMutex
+	ends leaseEnds
+}
+
+func newLeaseFile(path, format string) (*leaseFile, error) {
+	parse := leaseParsers[format]
+	l := &leaseFile{now: time.Now}
+	f, err := newWatchedFile(path, func(r io.Reader) (hostsMap, error) {
+		hosts, ends, err := parse(r, l.now())
+		if err == nil {
+			l.mu.Lock()
+			l.ends = ends
+			l.mu.Unlock()
+		}
+		return hosts, err
+	})
+	l.watchedFile = f
+	return l, err
+}
+
+func (l *leaseFile) lookup(name string) ([]net.IP, bool) {
+	name = strings.ToLower(name)
+	if l.zone == "" || name == l.zone || !dns.IsSubDomain(l.zone, name) {
+		return nil, false
+	}
+	ips, ok := l.watchedFile.lookup(name[:len(name)-len(l.zone)])
+	if !ok {
+		return nil, false
+	}
+	now := l.now()
+	var active []net.IP
+	l.mu.RLock()
+	for _, ip := range ips {
+		if ends, ok := l.ends[ip.String()]; ok && !ends.After(now) {
+			continue
+		}
+		active = append(active, ip)
+	}
+	l.mu.RUnlock()
+	return active, len(active) > 0
+}
+
+// parseDnsmasqLeases parses dnsmasq.leases, where every line is
+// "<expiry> <mac or iaid> <ip> <hostname> <client id>".
+func parseDnsmasqLeases(r io.Reader, now time.Time) (hostsMap, leaseEnds, error) {
+	hosts := hostsMap{}
+	ends := leaseEnds{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] == "*" {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		// zero expiry is for infinite leases
+		if expiry != 0 && !time.Unix(expiry, 0).After(now) {
+			continue
+		}
+		if ip := net.ParseIP(fields[2]); ip != nil {
+			hosts.add(ip, fields[3])
+			if expiry != 0 {
+				ends[ip.String()] = time.Unix(expiry, 0)
+			}
+		}
+	}
+	return hosts, ends, scanner.Err()
+}
+
+type dhcpdLease struct {
+	ip       net.IP
+	hostname string
+	ends     time.Time // zero for "ends never"
+	active   bool
+}
+
+// parseDhcpdLeases parses IPv4 leases of ISC dhcpd.leases. The file is
+// a journal, so the last record of an address wins.
+func parseDhcpdLeases(r io.Reader, now time.Time) (hostsMap, leaseEnds, error) {
+	var (
+		leases = map[string]*dhcpdLease{}
+		order  []string
+		cur    *dhcpdLease
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if cur == nil {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "lease" && fields[2] == "{" {
+				cur = &dhcpdLease{ip: net.ParseIP(fields[1])}
+			}
+			continue
+		}
+		if line == "}" {
+			if cur.ip != nil {
+				key := cur.ip.String()
+				if _, ok := leases[key]; !ok {
+					order = append(order, key)
+				}
+				leases[key] = cur
+			}
+			cur = nil
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case len(fields) == 3 && fields[0] == "binding" && fields[1] == "state":
+			cur.active = fields[2] == "active"
+		case len(fields) == 2 && fields[0] == "client-hostname":
+			cur.hostname = strings.Trim(fields[1], `"`)
+		case len(fields) >= 2 && fields[0] == "ends":
+			cur.ends = parseDhcpdTime(fields[1:])
+		}
+	}
+
+	hosts := hostsMap{}
+	ends := leaseEnds{}
+	for _, key := range order {
+		l := leases[key]
+		if !l.active || l.hostname == "" || (!l.ends.IsZero() && !l.ends.After(now)) {
+			continue
+		}
+		hosts.add(l.ip, l.hostname)
+		if !l.ends.IsZero() {
+			ends[key] = l.ends
+		}
+	}
+	return hosts, ends, scanner.Err()
+}
+
+// parseDhcpdTime parses "<weekday> <date> <time>", "epoch <seconds>" or
+// "never" (returns zero time), dates are in UTC.
+func parseDhcpdTime(fields []string) time.Time {
+	switch {
+	case len(fields) == 3:
+		t, err := time.Parse(dhcpdTimeLayout, fields[1]+" "+fields[2])
+		if err == nil {
+			return t
+		}
+	case len(fields) == 2 && fields[0] == "epoch":
+		if sec, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			return time.Unix(sec, 0)
+		}
+	case len(fields) == 1 && fields[0] == "never":
+		return time.Time{}
+	}
+	// unknown format, consider the lease expired
+	return time.Unix(0, 0)
+}
@@ -0,0 +1,188 @@
+package localstar
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DHCPTestSuite struct {
+	suite.Suite
+	now time.Time
+}
+
+func TestDHCPTestSuite(t *testing.T) {
+	suite.Run(t, new(DHCPTestSuite))
+}
+
+func (s *DHCPTestSuite) SetupTest() {
+	s.now = time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC)
+}
+
+func (s *DHCPTestSuite) ips(hosts hostsMap, name string) []string {
+	var res []string
+	ips, _ := hosts.lookup(name)
+	for _, ip := range ips {
+		res = append(res, ip.String())
+	}
+	return res
+}
+
+func (s *DHCPTestSuite) Test_parseDnsmasqLeases() {
+	now := s.now.Unix()
+	hosts, ends, err := parseDnsmasqLeases(strings.NewReader(strings.Join([]string{
+		strconv.FormatInt(now+3600, 10) + " 00:11:22:33:44:55 10.1.1.1 host1 01:00:11:22:33:44:55",
+		strconv.FormatInt(now-3600, 10) + " 00:11:22:33:44:56 10.1.1.2 host2 *",
+		"0 00:11:22:33:44:57 10.1.1.3 Host3 *",
+		strconv.FormatInt(now+3600, 10) + " 00:11:22:33:44:58 10.1.1.4 * *",
+		"duid 00:01:00:01:27:5b:49:4c:00:11:22:33:44:55",
+		strconv.FormatInt(now+3600, 10) + " 1234 fd00::1 host1 00:01:00:01:27:5b:49:4c:00:11:22:33:44:55",
+		"bad line",
+		"",
+	}, "\n")), s.now)
+	if s.NoError(err) {
+		s.Len(hosts, 2)
+		s.Equal([]string{"10.1.1.1", "fd00::1"}, s.ips(hosts, "host1."))
+		s.Equal([]string{"10.1.1.3"}, s.ips(hosts, "host3."))
+		s.Equal(leaseEnds{
+			"10.1.1.1": time.Unix(now+3600, 0),
+			"fd00::1":  time.Unix(now+3600, 0),
+		}, ends)
+	}
+}
+
+func (s *DHCPTestSuite) Test_parseDhcpdLeases() {
+	hosts, ends, err := parseDhcpdLeases(strings.NewReader(`
+# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 10.1.1.1 {
+  starts 4 2021/03/04 10:00:00;
+  ends 4 2021/03/04 22:00:00;
+  binding state active;
+  next binding state free;
+  hardware ethernet 00:11:22:33:44:55;
+  client-hostname "host1";
+}
+lease 10.1.1.2 {
+  starts 4 2021/03/04 10:00:00;
+  ends 4 2021/03/04 11:00:00;
+  binding state active;
+  client-hostname "host2";
+}
+lease 10.1.1.3 {
+  starts 4 2021/03/04 10:00:00;
+  ends never;
+  binding state active;
+  client-hostname "host3";
+}
+lease 10.1.1.4 {
+  starts 4 2021/03/04 10:00:00;
+  ends epoch 1614859200; # 2021/03/04 12:00:00
+  binding state active;
+  client-hostname "host4";
+}
+lease 10.1.1.5 {
+  ends 4 2021/03/04 22:00:00;
+  binding state active;
+}
+lease 10.1.1.6 {
+  ends 4 2021/03/04 22:00:00;
+  binding state active;
+  client-hostname "host6";
+}
+lease 10.1.1.6 {
+  ends 4 2021/03/04 22:00:00;
+  binding state free;
+  client-hostname "host6";
+}
+lease 10.1.1.7 {
+  ends 4 2021/03/04 22:00:00;
+  binding state free;
+  client-hostname "host7";
+}
+lease 10.1.1.7 {
+  ends 4 2021/03/04 22:00:00;
+  binding state active;
+  client-hostname "host1";
+}
+`), s.now)
+	if s.NoError(err) {
+		s.Len(hosts, 2)
+		s.Equal([]string{"10.1.1.1", "10.1.1.7"}, s.ips(hosts, "host1."))
+		s.Equal([]string{"10.1.1.3"}, s.ips(hosts, "host3."))
+		s.Equal(leaseEnds{
+			"10.1.1.1": time.Date(2021, 3, 4, 22, 0, 0, 0, time.UTC),
+			"10.1.1.7": time.Date(2021, 3, 4, 22, 0, 0, 0, time.UTC),
+		}, ends)
+	}
+}
+
+func (s *DHCPTestSuite) Test_parseDhcpdTime() {
+	s.Equal(time.Date(2021, 3, 4, 22, 0, 0, 0, time.UTC), parseDhcpdTime([]string{"4", "2021/03/04", "22:00:00"}))
+	s.Equal(time.Unix(1614859200, 0), parseDhcpdTime([]string{"epoch", "1614859200"}))
+	s.True(parseDhcpdTime([]string{"never"}).IsZero())
+	s.Equal(time.Unix(0, 0), parseDhcpdTime([]string{"4", "2021-03-04", "22:00:00"}))
+	s.Equal(time.Unix(0, 0), parseDhcpdTime([]string{}))
+}
+
+func (s *DHCPTestSuite) Test_leaseFile() {
+	tmpfile, err := ioutil.TempFile("", "dnsmasq.leases.*")
+	s.Require().NoError(err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.WriteString("0 00:11:22:33:44:55 10.1.1.1 host1 *\n")
+	tmpfile.Close()
+
+	f, err := newLeaseFile(tmpfile.Name(), "dnsmasq")
+	s.Require().NoError(err)
+	_, ok := f.lookup("host1.corp.net.")
+	s.False(ok)
+
+	f.zone = "corp.net."
+	ips, ok := f.lookup("Host1.Corp.Net.")
+	s.True(ok)
+	s.Equal([]net.IP{net.ParseIP("10.1.1.1")}, ips)
+	for _, name := range []string{"host1.", "corp.net.", "host1.other.net.", "a.host1.corp.net."} {
+		_, ok = f.lookup(name)
+		s.False(ok, name)
+	}
+
+	_, err = newLeaseFile(tmpfile.Name()+".missing", "dnsmasq")
+	s.Error(err)
+}
+
+func (s *DHCPTestSuite) Test_leaseFile_expiry() {
+	tmpfile, err := ioutil.TempFile("", "dnsmasq.leases.*")
+	s.Require().NoError(err)
+	defer os.Remove(tmpfile.Name())
+	expiry := time.Now().Add(time.Hour).Unix()
+	tmpfile.WriteString(strconv.FormatInt(expiry, 10) + " 00:11:22:33:44:55 10.1.1.1 host1 *\n")
+	tmpfile.WriteString(strconv.FormatInt(expiry+3600, 10) + " 00:11:22:33:44:56 fd00::1 host1 *\n")
+	tmpfile.WriteString("0 00:11:22:33:44:57 10.1.1.2 host2 *\n")
+	tmpfile.Close()
+
+	f, err := newLeaseFile(tmpfile.Name(), "dnsmasq")
+	s.Require().NoError(err)
+	f.zone = "corp.net."
+	ips, ok := f.lookup("host1.corp.net.")
+	s.True(ok)
+	s.Equal([]net.IP{net.ParseIP("10.1.1.1"), net.ParseIP("fd00::1")}, ips)
+
+	// the file is not rewritten, but the first lease expires
+	f.now = func() time.Time { return time.Unix(expiry, 0) }
+	s.NoError(f.readIfChanged())
+	ips, ok = f.lookup("host1.corp.net.")
+	s.True(ok)
+	s.Equal([]net.IP{net.ParseIP("fd00::1")}, ips)
+
+	f.now = func() time.Time { return time.Unix(expiry+3600, 0) }
+	_, ok = f.lookup("host1.corp.net.")
+	s.False(ok)
+	ips, ok = f.lookup("host2.corp.net.")
+	s.True(ok)
+	s.Equal([]net.IP{net.ParseIP("10.1.1.2")}, ips)
+}
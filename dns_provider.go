@@ -2,22 +2,52 @@ package localstar
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+var errInvalidResponse = errors.New("invalid upstream response")
+
+// validRcodes are rcodes expected in a response to a query.
+var validRcodes = map[int]bool{
+	dns.RcodeSuccess:        true,
+	dns.RcodeFormatError:    true,
+	dns.RcodeServerFailure:  true,
+	dns.RcodeNameError:      true,
+	dns.RcodeNotImplemented: true,
+	dns.RcodeRefused:        true,
+}
+
 type dnsProvider interface {
 	Init(endpoints []string, timeout time.Duration) error
 	Exchange(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error)
 }
 
+// endpointProvider exchanges queries with a single endpoint, responses
+// are validated and failed over by compositeDNSProvider.
+type endpointProvider interface {
+	Exchange(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error)
+}
+
 type dnsProviderInit func ([]string, time.Duration) error
 type dnsProviderExchange func (context.Context, *dns.Msg) (*dns.Msg, error)
 
+// simpleDNSProvider sends queries over UDP (retried over TCP if truncated)
+// or DNS over TLS. Every query is sent over a new connection, for DNS over
+// TLS it costs a TCP and TLS handshake per query (abbreviated if tlsConfig
+// has ClientSessionCache).
 type simpleDNSProvider struct {
-	endpoint string
-	timeout  time.Duration
+	addr      string
+	timeout   time.Duration
+	net       string      // "udp" if empty or "tcp-tls"
+	tlsConfig *tls.Config // for "tcp-tls"
+	tsig      *tsigKey    // signs queries and verifies responses if set
 }
 
 // stubDNSProvider used in tests
@@ -28,19 +58,157 @@ type stubDNSProvider struct {
 
 // TODO: Add forward pluging provider
 
-
-func (p *simpleDNSProvider) Init(endpoints []string, timeout time.Duration) error {
-	p.endpoint = endpoints[0]
-	p.timeout = timeout
+// validateResponse checks that res is a sane response to req, the case of
+// question names must be preserved if matchCase is set (DNS 0x20).
+func validateResponse(req, res *dns.Msg, matchCase bool) error {
+	switch {
+	case res == nil:
+		return fmt.Errorf("%w: empty response", errInvalidResponse)
+	case !res.Response:
+		return fmt.Errorf("%w: not a response", errInvalidResponse)
+	case res.Id != req.Id:
+		return fmt.Errorf("%w: id mismatch", errInvalidResponse)
+	case res.Opcode != req.Opcode:
+		return fmt.Errorf("%w: opcode mismatch", errInvalidResponse)
+	case !validRcodes[res.Rcode]:
+		return fmt.Errorf("%w: unexpected rcode %s", errInvalidResponse, dns.RcodeToString[res.Rcode])
+	case len(res.Question) != len(req.Question):
+		return fmt.Errorf("%w: question mismatch", errInvalidResponse)
+	}
+	for i, q := range req.Question {
+		r := res.Question[i]
+		if !strings.EqualFold(q.Name, r.Name) || q.Qtype != r.Qtype || q.Qclass != r.Qclass {
+			return fmt.Errorf("%w: question mismatch", errInvalidResponse)
+		}
+		if matchCase && q.Name != r.Name {
+			return fmt.Errorf("%w: case of question is not preserved", errInvalidResponse)
+		}
+	}
 	return nil
 }
 
+
+// Exchange sends msg to the endpoint, signing it and checking the
+// signature of the response if TSIG is set.
 func (p *simpleDNSProvider) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
-	client := &dns.Client{Net: "udp", Timeout: p.timeout}
-	res, _, err := client.ExchangeContext(ctx, msg, p.endpoint)
+	req := msg
+	if p.tsig != nil {
+		// the client strips the TSIG record when signing the message
+		req = msg.Copy()
+		req.SetTsig(p.tsig.name, p.tsig.algorithm, tsigFudge, time.Now().Unix())
+	}
+	res, err := p.exchange(ctx, req)
+	if p.tsig != nil && res != nil {
+		// the client returns the response along with verification errors
+		if err == nil {
+			err = checkResponseTsig(res)
+		}
+		if err != nil {
+			log.Warningf("TSIG check of response from %s failed: %s", p.addr, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// exchange sends req to the endpoint, truncated UDP responses are repeated
+// over TCP.
+func (p *simpleDNSProvider) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	network := p.net
+	if network == "" {
+		network = "udp"
+	}
+	res, err := p.exchangeOver(ctx, req, network)
+	if err == nil && network == "udp" && res.Truncated {
+		return p.exchangeOver(ctx, req, "tcp")
+	}
 	return res, err
 }
 
+// exchangeOver sends req to the endpoint over network, it is aborted by
+// closing the connection once ctx is done, timeouts are not longer than ctx
+// deadline.
+func (p *simpleDNSProvider) exchangeOver(ctx context.Context, req *dns.Msg, network string) (*dns.Msg, error) {
+	timeout, ctxDeadline := p.timeout, false
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < timeout {
+			timeout, ctxDeadline = left, true
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	c := &dns.Client{Net: network, Timeout: timeout, TLSConfig: p.tlsConfig}
+	if p.tsig != nil {
+		c.TsigSecret = map[string]string{p.tsig.name: p.tsig.secret}
+	}
+	conn, err := p.dial(ctx, network, timeout)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func () {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer conn.Close()
+
+	res, _, err := c.ExchangeWithConn(req, conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// deadlines of the connection may pass a bit earlier than ctx one
+		var netErr net.Error
+		if ctxDeadline && errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	return res, err
+}
+
+// dial connects to the endpoint, the dial is aborted once ctx is done.
+func (p *simpleDNSProvider) dial(ctx context.Context, network string, timeout time.Duration) (*dns.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	var (conn net.Conn; err error)
+	if network == "tcp-tls" {
+		td := &tls.Dialer{NetDialer: d, Config: p.tlsConfig}
+		conn, err = td.DialContext(ctx, "tcp", p.addr)
+	} else {
+		conn, err = d.DialContext(ctx, network, p.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// checkResponseTsig makes sure the response was signed, the signature
+// itself is verified by dns.Client. The TSIG record is removed, so it is
+// not passed to clients.
+func checkResponseTsig(res *dns.Msg) error {
+	t := res.IsTsig()
+	if t == nil {
+		return errTsigUnsigned
+	}
+	if t.Error != dns.RcodeSuccess {
+		return fmt.Errorf("%w: %s", dns.ErrAuth, dns.RcodeToString[int(t.Error)])
+	}
+	res.Extra = res.Extra[:len(res.Extra)-1]
+	return nil
+}
 
 func (p *stubDNSProvider) Init(endpoints []string, timeout time.Duration) error {
 	if p.initCb != nil {
@@ -2,7 +2,9 @@ package localstar
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,9 +21,11 @@ func TestSimpleDNSProviderTestSuite(t *testing.T) {
 }
 
 func (s *SimpleDNSProviderTestSuite) Test_exchange() {
-	// test it works with Google Public DNS
-	p := new(simpleDNSProvider)
-	p.Init([]string{"8.8.8.8:53"}, 4 * time.Second)
+	server := startFakeServer(s.T(),
+		"publicdns.google.com. 60 IN A 8.8.8.8",
+		"publicdns.google.com. 60 IN A 8.8.4.4",
+	)
+	p := &simpleDNSProvider{addr: server.addr, timeout: 4 * time.Second}
 	msg := new(dns.Msg)
 	msg.SetQuestion("publicdns.google.com.", dns.TypeA)
 	res, err := p.Exchange(context.Background(), msg)
@@ -36,14 +40,17 @@ func (s *SimpleDNSProviderTestSuite) Test_exchange() {
 		expectedIps := []string{"8.8.8.8", "8.8.4.4"}
 		s.ElementsMatch(expectedIps, ips)
 	}
+	s.Equal(1, server.calls())
 }
 
 func (s *SimpleDNSProviderTestSuite) Test_exchange_timeout() {
 	var (err error; dur time.Duration; ctx context.Context; cancel context.CancelFunc)
 
+	server := startFakeServer(s.T())
+	server.setFaults(fakeFaults{drop: true})
+
 	exch := func (t time.Duration, ctx context.Context) (time.Duration, error) {
-		p := new(simpleDNSProvider)
-		p.Init([]string{"127.126.125.124:53"}, t)
+		p := &simpleDNSProvider{addr: server.addr, timeout: t}
 		msg := new(dns.Msg)
 		msg.SetQuestion("localhost.", dns.TypeA)
 		start := time.Now()
@@ -66,11 +73,201 @@ func (s *SimpleDNSProviderTestSuite) Test_exchange_timeout() {
 	dur, err = exch(1*time.Second, ctx)
 	if s.Error(err) {
 		s.InDelta(30*time.Millisecond, dur, float64(5*time.Millisecond))
-		// NOTE: Context is not supported by underlying API, so we get back net error
-		var ne *net.OpError
-		if s.ErrorAs(err, &ne) {
-			s.True(ne.Timeout())
-		}
+		s.ErrorIs(err, context.DeadlineExceeded)
 	}
 	cancel()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(30*time.Millisecond, cancel)
+	dur, err = exch(1*time.Second, ctx)
+	if s.Error(err) {
+		s.InDelta(30*time.Millisecond, dur, float64(5*time.Millisecond))
+		s.ErrorIs(err, context.Canceled)
+	}
+
+	// already done context
+	dur, err = exch(1*time.Second, ctx)
+	s.ErrorIs(err, context.Canceled)
+	s.Less(int64(dur), int64(5*time.Millisecond))
+}
+
+func (s *SimpleDNSProviderTestSuite) Test_exchange_dialCanceled() {
+	// accepts connections, but never completes TLS handshakes
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer ln.Close()
+	go func () {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	p := &simpleDNSProvider{addr: ln.Addr().String(), timeout: time.Second, net: "tcp-tls", tlsConfig: new(tls.Config)}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(30*time.Millisecond, cancel)
+	msg := new(dns.Msg)
+	msg.SetQuestion("localhost.", dns.TypeA)
+	start := time.Now()
+	res, err := p.Exchange(ctx, msg)
+	s.Nil(res)
+	s.ErrorIs(err, context.Canceled)
+	s.InDelta(30*time.Millisecond, time.Since(start), float64(10*time.Millisecond))
+}
+
+func (s *SimpleDNSProviderTestSuite) Test_validateResponse() {
+	req := new(dns.Msg)
+	req.SetQuestion("host1.corp.net.", dns.TypeA)
+	reply := func (modify func (*dns.Msg)) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		modify(res)
+		return res
+	}
+
+	s.NoError(validateResponse(req, reply(func (m *dns.Msg) {}), false))
+	s.NoError(validateResponse(req, reply(func (m *dns.Msg) { m.Question[0].Name = "Host1.Corp.Net." }), false))
+	s.ErrorIs(validateResponse(req, reply(func (m *dns.Msg) { m.Question[0].Name = "Host1.Corp.Net." }), true), errInvalidResponse)
+	s.NoError(validateResponse(req, reply(func (m *dns.Msg) {}), true))
+	s.NoError(validateResponse(req, reply(func (m *dns.Msg) { m.Rcode = dns.RcodeNameError }), false))
+	s.NoError(validateResponse(req, reply(func (m *dns.Msg) { m.Rcode = dns.RcodeServerFailure }), false))
+
+	for name, res := range map[string]*dns.Msg{
+		"empty": nil,
+		"not response": reply(func (m *dns.Msg) { m.Response = false }),
+		"id": reply(func (m *dns.Msg) { m.Id++ }),
+		"opcode": reply(func (m *dns.Msg) { m.Opcode = dns.OpcodeNotify }),
+		"rcode": reply(func (m *dns.Msg) { m.Rcode = dns.RcodeNotAuth }),
+		"no question": reply(func (m *dns.Msg) { m.Question = nil }),
+		"name": reply(func (m *dns.Msg) { m.Question[0].Name = "host2.corp.net." }),
+		"type": reply(func (m *dns.Msg) { m.Question[0].Qtype = dns.TypeAAAA }),
+		"class": reply(func (m *dns.Msg) { m.Question[0].Qclass = dns.ClassCHAOS }),
+	}{
+		s.ErrorIs(validateResponse(req, res, false), errInvalidResponse, name)
+	}
+}
+
+func (s *SimpleDNSProviderTestSuite) Test_exchange_tsig() {
+	key, err := newTsigKey("upstream-key", "hmac-sha256", "c2VjcmV0IGtleSBmb3IgdGVzdHM=")
+	s.Require().NoError(err)
+	secrets := map[string]string{key.name: key.secret}
+	var signed int32
+	reply := func (sign bool) dns.HandlerFunc {
+		return func (w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A: net.ParseIP("10.1.1.1"),
+			})
+			if t := req.IsTsig(); t != nil && w.TsigStatus() == nil {
+				atomic.AddInt32(&signed, 1)
+				if sign {
+					res.SetTsig(t.Hdr.Name, t.Algorithm, tsigFudge, time.Now().Unix())
+				}
+			}
+			w.WriteMsg(res)
+		}
+	}
+	startServer := func (secrets map[string]string, handler dns.HandlerFunc) string {
+		server := &fakeServer{handler: handler, tsigSecret: secrets}
+		server.start(s.T())
+		return server.addr
+	}
+	signingAddr := startServer(secrets, reply(true))
+	unsignedAddr := startServer(secrets, reply(false))
+	otherKeyAddr := startServer(map[string]string{key.name: "b3RoZXIgc2VjcmV0"}, reply(true))
+
+	exchange := func (endpoints ...string) (*dns.Msg, error) {
+		p := &compositeDNSProvider{opts: providerOptions{tsig: &key}}
+		s.Require().NoError(p.Init(endpoints, 1 * time.Second))
+		msg := new(dns.Msg)
+		msg.SetQuestion("host1.corp.net.", dns.TypeA)
+		res, err := p.Exchange(context.Background(), msg)
+		s.Nil(msg.IsTsig(), "request must not be modified")
+		return res, err
+	}
+
+	res, err := exchange(signingAddr)
+	if s.NoError(err) && s.NotNil(res) {
+		s.Len(res.Answer, 1)
+		s.Empty(res.Extra)
+	}
+	s.EqualValues(1, atomic.LoadInt32(&signed))
+
+	res, err = exchange(unsignedAddr)
+	s.Nil(res)
+	s.Equal(errTsigUnsigned, err)
+	s.EqualValues(2, atomic.LoadInt32(&signed))
+
+	res, err = exchange(otherKeyAddr)
+	s.Nil(res)
+	s.Error(err)
+	s.EqualValues(2, atomic.LoadInt32(&signed))
+
+	res, err = exchange(otherKeyAddr, unsignedAddr, signingAddr)
+	s.NoError(err)
+	s.NotNil(res)
+}
+
+func (s *SimpleDNSProviderTestSuite) Test_exchange_faults() {
+	server := startFakeServer(s.T(), "host1.corp.net. 60 IN A 10.1.1.1")
+	var attemptTimeout time.Duration
+	exchange := func (name string, endpoints ...string) (*dns.Msg, error) {
+		p := &compositeDNSProvider{retry: retryPolicy{attempts: 1, attemptTimeout: attemptTimeout}}
+		s.Require().NoError(p.Init(endpoints, 100 * time.Millisecond))
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		return p.Exchange(context.Background(), msg)
+	}
+
+	res, err := exchange("host2.corp.net.", server.addr)
+	if s.NoError(err) {
+		s.Equal(dns.RcodeNameError, res.Rcode)
+	}
+
+	server.setFaults(fakeFaults{rcode: dns.RcodeServerFailure})
+	res, err = exchange("host1.corp.net.", server.addr)
+	if s.NoError(err) {
+		s.Equal(dns.RcodeServerFailure, res.Rcode)
+	}
+
+	// truncated responses are repeated over TCP
+	server.setFaults(fakeFaults{truncate: true})
+	calls := server.calls()
+	res, err = exchange("host1.corp.net.", server.addr)
+	if s.NoError(err) {
+		s.False(res.Truncated)
+		s.Len(res.Answer, 1)
+	}
+	s.Equal(calls + 2, server.calls())
+
+	// responses with wrong ids are ignored until timeout
+	server.setFaults(fakeFaults{wrongID: true})
+	_, err = exchange("host1.corp.net.", server.addr)
+	var ne net.Error
+	if s.ErrorAs(err, &ne) {
+		s.True(ne.Timeout())
+	}
+
+	server.setFaults(fakeFaults{delay: 20 * time.Millisecond})
+	res, err = exchange("host1.corp.net.", server.addr)
+	if s.NoError(err) {
+		s.Len(res.Answer, 1)
+	}
+
+	// the next endpoint is tried once the attempt timeout of a dropping
+	// one passes
+	dropping := startFakeServer(s.T())
+	dropping.setFaults(fakeFaults{drop: true})
+	server.setFaults(fakeFaults{})
+	attemptTimeout = 40 * time.Millisecond
+	res, err = exchange("host1.corp.net.", dropping.addr, server.addr)
+	if s.NoError(err) {
+		s.Len(res.Answer, 1)
+	}
+	s.Equal(1, dropping.calls())
 }
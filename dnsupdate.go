@@ -0,0 +1,364 @@
+package localstar
+
+// Dynamic updates (RFC 2136) for names directly under the serving zone.
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// updateMsgAcceptFunc makes a server accept UPDATE messages, which are
+// rejected by dns.DefaultMsgAcceptFunc.
+func updateMsgAcceptFunc(next dns.MsgAcceptFunc) dns.MsgAcceptFunc {
+	return func(dh dns.Header) dns.MsgAcceptAction {
+		isResponse := dh.Bits&(1<<15) != 0
+		opcode := int(dh.Bits>>11) & 0xF
+		if isResponse || opcode != dns.OpcodeUpdate {
+			return next(dh)
+		}
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+}
+
+// updateStore is a hostSource with addresses registered by dynamic updates.
+// CoreDNS servers reject UPDATE messages before they reach plugins, so
+// updates are received by own servers listening on addr. Keys of a server
+// block share one store (see shareSources), messages are passed to the
+// instance serving the zone in question.
+type updateStore struct {
+	keys     map[string]tsigKey
+	addr     string
+	zones    []string // in order of handle calls
+	handlers map[string]dns.Handler
+
+	*updateHosts
+
+	bound   string // address the servers listen on
+	servers []*dns.Server
+}
+
+// updateHosts are addresses registered by dynamic updates, they are passed
+// to the new store on reload.
+type updateHosts struct {
+	mu    sync.RWMutex
+	hosts hostsMap
+}
+
+// On reload the new instance is started before the old one is stopped, the
+// new store takes over hosts of the running one on the same address.
+var (
+	updateStoresMu sync.Mutex
+	updateStores   = map[string]*updateStore{}
+)
+
+func newUpdateStore() *updateStore {
+	return &updateStore{
+		keys:        map[string]tsigKey{},
+		handlers:    map[string]dns.Handler{},
+		updateHosts: &updateHosts{hosts: hostsMap{}},
+	}
+}
+
+// handle sets the handler of updates for zone.
+func (u *updateStore) handle(zone string, h dns.Handler) {
+	if _, ok := u.handlers[zone]; !ok {
+		u.zones = append(u.zones, zone)
+	}
+	u.handlers[zone] = h
+}
+
+// ServeDNS implements the dns.Handler interface, messages for unknown zones
+// are passed to the first handler, which replies with an error.
+func (u *updateStore) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(u.zones) == 0 {
+		return
+	}
+	h := u.handlers[u.zones[0]]
+	if len(req.Question) == 1 {
+		if zh, ok := u.handlers[strings.ToLower(req.Question[0].Name)]; ok {
+			h = zh
+		}
+	}
+	h.ServeDNS(w, req)
+}
+
+// start implements runnable. Sockets are opened with SO_REUSEPORT, so on
+// reload the new instance can listen before the old one is stopped.
+func (u *updateStore) start() error {
+	pc, err := reuseport.ListenPacket("udp", u.addr)
+	if err != nil {
+		return err
+	}
+	ln, err := reuseport.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	u.takeOver(pc.LocalAddr().String())
+	secrets := map[string]string{}
+	for name, key := range u.keys {
+		secrets[name] = key.secret
+	}
+	accept := updateMsgAcceptFunc(dns.DefaultMsgAcceptFunc)
+	u.servers = []*dns.Server{
+		{PacketConn: pc, Net: "udp", Handler: u, MsgAcceptFunc: accept, TsigSecret: secrets},
+		{Listener: ln, Net: "tcp", Handler: u, MsgAcceptFunc: accept, TsigSecret: secrets},
+	}
+	for _, srv := range u.servers {
+		started := make(chan error, 1)
+		srv.NotifyStartedFunc = func() { started <- nil }
+		go func(srv *dns.Server) { started <- srv.ActivateAndServe() }(srv)
+		if err = <-started; err != nil {
+			u.stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// takeOver shares hosts of the store running on addr, so updates received
+// by either instance during reload are kept. It is called before the
+// instance serves queries.
+func (u *updateStore) takeOver(addr string) {
+	updateStoresMu.Lock()
+	defer updateStoresMu.Unlock()
+	if prev, ok := updateStores[addr]; ok {
+		u.updateHosts = prev.updateHosts
+	}
+	updateStores[addr] = u
+	u.bound = addr
+}
+
+// stop implements runnable.
+func (u *updateStore) stop() error {
+	updateStoresMu.Lock()
+	if updateStores[u.bound] == u {
+		delete(updateStores, u.bound)
+	}
+	updateStoresMu.Unlock()
+	var err error
+	for _, srv := range u.servers {
+		if e := srv.Shutdown(); e != nil {
+			err = e
+		}
+	}
+	u.servers = nil
+	return err
+}
+
+func (u *updateStore) lookup(name string) ([]net.IP, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.hosts.lookup(name)
+}
+
+// has reports whether the name has addresses of qtype, TypeANY matches both.
+func (u *updateStore) has(name string, qtype uint16) bool {
+	ips, ok := u.hosts[name]
+	if !ok {
+		return false
+	}
+	for _, ip := range ips {
+		if qtype == dns.TypeANY || qtype == ipType(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remove deletes addresses of the name matching qtype (TypeANY matches
+// both) and ip (nil matches all).
+func (u *updateStore) remove(name string, qtype uint16, ip net.IP) {
+	var ips []net.IP
+	for _, addr := range u.hosts[name] {
+		matchType := qtype == dns.TypeANY || qtype == ipType(addr)
+		if !matchType || (ip != nil && !ip.Equal(addr)) {
+			ips = append(ips, addr)
+		}
+	}
+	if len(ips) == 0 {
+		delete(u.hosts, name)
+	} else {
+		u.hosts[name] = ips
+	}
+}
+
+func (u *updateStore) add(name string, ip net.IP) {
+	for _, addr := range u.hosts[name] {
+		if addr.Equal(ip) {
+			return
+		}
+	}
+	u.hosts[name] = append(u.hosts[name], ip)
+}
+
+func ipType(ip net.IP) uint16 {
+	if ip.To4() != nil {
+		return dns.TypeA
+	}
+	return dns.TypeAAAA
+}
+
+// rrIP returns the address of A and AAAA records.
+func rrIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// serveUpdate handles a message received by the update servers, which
+// have verified its TSIG against the original wire bytes.
+func (ls LocalStar) serveUpdate(w dns.ResponseWriter, req *dns.Msg) {
+	state := &request.Request{W: w, Req: req}
+	if ls.acl != nil && !ls.acl.allowed(net.ParseIP(state.IP()), state.QType()) {
+		if !ls.acl.drop {
+			ls.serveError(w, req, errACLDenied, "")
+		}
+		return
+	}
+	if req.Opcode != dns.OpcodeUpdate {
+		ls.serveError(w, req, errNotImplemented, "")
+		return
+	}
+	rep := new(dns.Msg)
+	rep.SetReply(req)
+
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		rep.Rcode = dns.RcodeFormatError
+		w.WriteMsg(rep)
+		return
+	}
+	if !strings.EqualFold(req.Question[0].Name, ls.fromZone) {
+		rep.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(rep)
+		return
+	}
+
+	t := req.IsTsig()
+	if t == nil {
+		rep.Rcode = dns.RcodeRefused
+		w.WriteMsg(rep)
+		return
+	}
+	key, ok := ls.updates.keys[strings.ToLower(t.Hdr.Name)]
+	if !ok {
+		log.Warningf("Update for %s with unknown key %s", ls.fromZone, t.Hdr.Name)
+		rep.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(rep)
+		return
+	}
+	if err := verifyTsig(w, t, key); err != nil {
+		log.Warningf("Update for %s with key %s failed: %s", ls.fromZone, key.name, err)
+		rep.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(rep)
+		return
+	}
+
+	rep.Rcode = ls.applyUpdate(req)
+
+	// the reply is signed by the server
+	rep.SetTsig(t.Hdr.Name, key.algorithm, tsigFudge, time.Now().Unix())
+	if err := w.WriteMsg(rep); err != nil {
+		log.Errorf("Cannot write update reply: %s", err)
+	}
+}
+
+// updateName returns the lookup name for a name in the update message,
+// only names directly under the serving zone can be updated.
+func (ls LocalStar) updateName(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if !dns.IsSubDomain(ls.fromZone, name) || dns.CountLabel(name) != dns.CountLabel(ls.fromZone)+1 {
+		return "", false
+	}
+	lookupName, err := ls.getLookupName(name)
+	return lookupName, err == nil
+}
+
+// applyUpdate checks prerequisites and applies the update section of req
+// to the store atomically, it returns the rcode of the reply.
+func (ls LocalStar) applyUpdate(req *dns.Msg) int {
+	store := ls.updates
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// prerequisites, only value independent ones are supported
+	for _, rr := range req.Answer {
+		hdr := rr.Header()
+		name, ok := ls.updateName(hdr.Name)
+		if !ok {
+			return dns.RcodeNotZone
+		}
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		switch hdr.Class {
+		case dns.ClassANY:
+			if !store.has(name, hdr.Rrtype) {
+				if hdr.Rrtype == dns.TypeANY {
+					return dns.RcodeNameError
+				}
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if store.has(name, hdr.Rrtype) {
+				if hdr.Rrtype == dns.TypeANY {
+					return dns.RcodeYXDomain
+				}
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			return dns.RcodeNotImplemented
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// prescan the update section
+	names := make([]string, len(req.Ns))
+	for i, rr := range req.Ns {
+		hdr := rr.Header()
+		name, ok := ls.updateName(hdr.Name)
+		if !ok {
+			return dns.RcodeNotZone
+		}
+		names[i] = name
+		switch hdr.Class {
+		case dns.ClassINET, dns.ClassNONE:
+			if rrIP(rr) == nil {
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if hdr.Rrtype != dns.TypeANY && hdr.Rrtype != dns.TypeA && hdr.Rrtype != dns.TypeAAAA {
+				return dns.RcodeRefused
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for i, rr := range req.Ns {
+		hdr := rr.Header()
+		switch hdr.Class {
+		case dns.ClassINET:
+			store.add(names[i], rrIP(rr))
+		case dns.ClassNONE:
+			store.remove(names[i], hdr.Rrtype, rrIP(rr))
+		case dns.ClassANY:
+			store.remove(names[i], hdr.Rrtype, nil)
+		}
+	}
+	return dns.RcodeSuccess
+}
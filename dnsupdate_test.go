@@ -0,0 +1,349 @@
+package localstar
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	testKeyName = "update-key."
+	testKeySecret = "c2VjcmV0IGtleSBmb3IgdGVzdHM="
+)
+
+type DNSUpdateTestSuite struct {
+	suite.Suite
+	ls LocalStar
+	updateAddr string
+}
+
+func TestDNSUpdateTestSuite(t *testing.T) {
+	suite.Run(t, new(DNSUpdateTestSuite))
+}
+
+func (s *DNSUpdateTestSuite) SetupTest() {
+	key, err := newTsigKey(testKeyName, "hmac-sha256", testKeySecret)
+	s.Require().NoError(err)
+	s.ls = LocalStar{fromZone: "dev.corp.net.", toZone: "corp.net.", toZoneDiff: "dev.", prefixLen: 1}
+	s.ls.updates = newUpdateStore()
+	s.ls.updates.keys[key.name] = key
+	s.ls.sources = []hostSource{s.ls.updates}
+	s.ls.updates.addr = "127.0.0.1:0"
+	// the store is shared with the reverse zone of the server block
+	reverse := LocalStar{fromZone: "10.in-addr.arpa.", toZone: "corp.net.", prefixLen: 1, reverse: true, updates: s.ls.updates}
+	s.ls.updates.handle(reverse.fromZone, dns.HandlerFunc(reverse.serveUpdate))
+	s.ls.updates.handle(s.ls.fromZone, dns.HandlerFunc(func (w dns.ResponseWriter, req *dns.Msg) {
+		s.ls.serveUpdate(w, req)
+	}))
+	s.Require().NoError(s.ls.updates.start())
+	s.updateAddr = s.ls.updates.servers[0].PacketConn.LocalAddr().String()
+}
+
+func (s *DNSUpdateTestSuite) TearDownTest() {
+	s.NoError(s.ls.updates.stop())
+}
+
+func (s *DNSUpdateTestSuite) addr() string {
+	return s.updateAddr
+}
+
+func rrs(records ...string) []dns.RR {
+	var res []dns.RR
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, rr)
+	}
+	return res
+}
+
+// send signs the update as a client would do, sends it to the update
+// server and returns the reply.
+func (s *DNSUpdateTestSuite) send(zone, keyName, secret string, build func(*dns.Msg)) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	build(m)
+	client := new(dns.Client)
+	if keyName != "" {
+		m.SetTsig(keyName, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+		client.TsigSecret = map[string]string{keyName: secret}
+	}
+	rep, _, err := client.Exchange(m, s.addr())
+	s.Require().NoError(err)
+	s.Equal(m.Id, rep.Id)
+	return rep
+}
+
+func (s *DNSUpdateTestSuite) lookup(name string) []string {
+	ips, _ := s.ls.updates.lookup(name)
+	var res []string
+	for _, ip := range ips {
+		res = append(res, ip.String())
+	}
+	return res
+}
+
+func (s *DNSUpdateTestSuite) Test_insert_remove() {
+	rep := s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+		m.Insert(rrs("host1.dev.corp.net. 60 IN A 10.1.1.1", "host1.dev.corp.net. 60 IN AAAA fd00::1", "Host2.Dev.Corp.Net. 60 IN A 10.1.1.2"))
+	})
+	s.Equal(dns.RcodeSuccess, rep.Rcode)
+	s.NotNil(rep.IsTsig())
+	s.Equal([]string{"10.1.1.1", "fd00::1"}, s.lookup("host1.corp.net."))
+	s.Equal([]string{"10.1.1.2"}, s.lookup("host2.corp.net."))
+
+	// same record is not duplicated
+	rep = s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+		m.Insert(rrs("host1.dev.corp.net. 60 IN A 10.1.1.1", "host1.dev.corp.net. 60 IN A 10.1.1.3"))
+	})
+	s.Equal(dns.RcodeSuccess, rep.Rcode)
+	s.Equal([]string{"10.1.1.1", "fd00::1", "10.1.1.3"}, s.lookup("host1.corp.net."))
+
+	s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+		m.Remove(rrs("host1.dev.corp.net. 0 IN A 10.1.1.1"))
+	})
+	s.Equal([]string{"fd00::1", "10.1.1.3"}, s.lookup("host1.corp.net."))
+
+	s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+		m.RemoveRRset(rrs("host1.dev.corp.net. 0 IN A 0.0.0.0"))
+	})
+	s.Equal([]string{"fd00::1"}, s.lookup("host1.corp.net."))
+
+	s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+		m.RemoveName(rrs("host1.dev.corp.net. 0 IN A 0.0.0.0", "host2.dev.corp.net. 0 IN A 0.0.0.0"))
+	})
+	s.Nil(s.lookup("host1.corp.net."))
+	s.Nil(s.lookup("host2.corp.net."))
+}
+
+func (s *DNSUpdateTestSuite) Test_zones() {
+	// updates are passed to the instance serving the zone
+	for i := 0; i < 5; i++ {
+		rep := s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+			m.Insert(rrs(fmt.Sprintf("host%d.dev.corp.net. 60 IN A 10.1.1.%d", i, i)))
+		})
+		s.Equal(dns.RcodeSuccess, rep.Rcode)
+	}
+	for i := 0; i < 5; i++ {
+		s.Len(s.lookup(fmt.Sprintf("host%d.corp.net.", i)), 1, i)
+	}
+	rep := s.send("10.in-addr.arpa.", testKeyName, testKeySecret, func (m *dns.Msg) {
+		m.Insert(rrs("host1.dev.corp.net. 60 IN A 10.1.1.1"))
+	})
+	s.Equal(dns.RcodeNotZone, rep.Rcode)
+}
+
+func (s *DNSUpdateTestSuite) Test_reload() {
+	s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+		m.Insert(rrs("host1.dev.corp.net. 60 IN A 10.1.1.1"))
+	})
+
+	// the new instance is started before the old one is stopped
+	ls := s.ls
+	ls.updates = newUpdateStore()
+	ls.updates.keys = s.ls.updates.keys
+	ls.updates.addr = s.addr()
+	ls.updates.handle(ls.fromZone, dns.HandlerFunc(ls.serveUpdate))
+	s.Require().NoError(ls.updates.start())
+	defer ls.updates.stop()
+	ips, _ := ls.updates.lookup("host1.corp.net.")
+	s.Len(ips, 1)
+
+	// updates received by either instance are seen by both
+	for i := 2; i < 6; i++ {
+		s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+			m.Insert(rrs(fmt.Sprintf("host%d.dev.corp.net. 60 IN A 10.1.1.%d", i, i)))
+		})
+	}
+	s.NoError(s.ls.updates.stop())
+	s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+		m.Insert(rrs("host6.dev.corp.net. 60 IN A 10.1.1.6"))
+	})
+	for i := 1; i <= 6; i++ {
+		ips, _ := ls.updates.lookup(fmt.Sprintf("host%d.corp.net.", i))
+		s.Len(ips, 1, i)
+	}
+}
+
+func (s *DNSUpdateTestSuite) Test_prerequisites() {
+	update := func (prereq func (*dns.Msg)) int {
+		return s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+			prereq(m)
+			m.Insert(rrs("host1.dev.corp.net. 60 IN A 10.1.1.1"))
+		}).Rcode
+	}
+	host1 := rrs("host1.dev.corp.net. 0 IN A 0.0.0.0")
+	host1AAAA := rrs("host1.dev.corp.net. 0 IN AAAA ::")
+
+	s.Equal(dns.RcodeNameError, update(func (m *dns.Msg) { m.NameUsed(host1) }))
+	s.Equal(dns.RcodeNXRrset, update(func (m *dns.Msg) { m.RRsetUsed(host1) }))
+	s.Nil(s.lookup("host1.corp.net."))
+
+	s.Equal(dns.RcodeSuccess, update(func (m *dns.Msg) { m.NameNotUsed(host1) }))
+	s.Equal(dns.RcodeYXDomain, update(func (m *dns.Msg) { m.NameNotUsed(host1) }))
+	s.Equal(dns.RcodeYXRrset, update(func (m *dns.Msg) { m.RRsetNotUsed(host1) }))
+	s.Equal(dns.RcodeSuccess, update(func (m *dns.Msg) { m.RRsetNotUsed(host1AAAA) }))
+	s.Equal(dns.RcodeSuccess, update(func (m *dns.Msg) { m.NameUsed(host1) }))
+	s.Equal(dns.RcodeNotImplemented, update(func (m *dns.Msg) { m.Used(host1) }))
+}
+
+func (s *DNSUpdateTestSuite) Test_errors() {
+	insert := func (m *dns.Msg) {
+		m.Insert(rrs("host1.dev.corp.net. 60 IN A 10.1.1.1"))
+	}
+	s.Equal(dns.RcodeNotAuth, s.send("corp.net.", testKeyName, testKeySecret, insert).Rcode)
+	s.Equal(dns.RcodeRefused, s.send("dev.corp.net.", "", "", insert).Rcode)
+	s.Equal(dns.RcodeNotAuth, s.send("dev.corp.net.", "other-key.", testKeySecret, insert).Rcode)
+	s.Equal(dns.RcodeNotAuth, s.send("dev.corp.net.", testKeyName, "b3RoZXIgc2VjcmV0", insert).Rcode)
+	s.Nil(s.lookup("host1.corp.net."))
+
+	for _, rr := range []string{
+		"host1.corp.net. 60 IN A 10.1.1.1",
+		"a.host1.dev.corp.net. 60 IN A 10.1.1.1",
+		"dev.corp.net. 60 IN A 10.1.1.1",
+		"dev.dev.corp.net. 60 IN A 10.1.1.1",
+	}{
+		rep := s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+			m.Insert(rrs("host1.dev.corp.net. 60 IN A 10.1.1.1", rr))
+		})
+		s.Equal(dns.RcodeNotZone, rep.Rcode, rr)
+	}
+	rep := s.send("dev.corp.net.", testKeyName, testKeySecret, func (m *dns.Msg) {
+		m.Insert(rrs("host1.dev.corp.net. 60 IN A 10.1.1.1", "host1.dev.corp.net. 60 IN TXT text"))
+	})
+	s.Equal(dns.RcodeRefused, rep.Rcode)
+	s.Nil(s.lookup("host1.corp.net."))
+
+	// queries are not served by the update server
+	q := new(dns.Msg)
+	q.SetQuestion("host1.dev.corp.net.", dns.TypeA)
+	rep, _, err := new(dns.Client).Exchange(q, s.addr())
+	if s.NoError(err) {
+		s.Equal(dns.RcodeNotImplemented, rep.Rcode)
+	}
+
+	// updates are not accepted by the plugin handler
+	m := new(dns.Msg)
+	m.SetUpdate("dev.corp.net.")
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	code, err := s.ls.ServeDNS(context.Background(), rec, m)
+	s.Equal(errNotImplemented, err)
+	s.Equal(dns.RcodeSuccess, code)
+	if s.NotNil(rec.Msg) {
+		s.Equal(dns.RcodeNotImplemented, rec.Msg.Rcode)
+	}
+}
+
+// Test_wire sends an update which miekg/dns would not pack this way: the
+// first owner name is not compressed while the second one is, so the MAC
+// can be verified only against the original bytes.
+func (s *DNSUpdateTestSuite) Test_wire() {
+	name := func (n string) []byte {
+		buf := make([]byte, 256)
+		off, err := dns.PackDomainName(n, buf, 0, nil, false)
+		s.Require().NoError(err)
+		return buf[:off]
+	}
+	u16 := func (v uint16) []byte { return []byte{byte(v >> 8), byte(v)} }
+	u32 := func (v uint32) []byte { return append(u16(uint16(v >> 16)), u16(uint16(v))...) }
+	time48 := func (t int64) []byte { return append(u16(uint16(t >> 32)), u32(uint32(t))...) }
+
+	const id = 0x1234
+	msg := append(u16(id), u16(dns.OpcodeUpdate<<11)...)
+	msg = append(msg, 0, 1, 0, 0, 0, 2, 0, 0)
+	msg = append(msg, name("dev.corp.net.")...)
+	msg = append(msg, 0, 6, 0, 1)
+	msg = append(msg, name("host1.dev.corp.net.")...)
+	msg = append(msg, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 1, 1, 1)
+	msg = append(msg, 5, 'h', 'o', 's', 't', '1', 0xC0, 12)
+	msg = append(msg, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 1, 1, 2)
+
+	now := time.Now().Unix()
+	secret, err := base64.StdEncoding.DecodeString(testKeySecret)
+	s.Require().NoError(err)
+	h := hmac.New(sha256.New, secret)
+	h.Write(msg)
+	h.Write(name(testKeyName))
+	h.Write(u16(dns.ClassANY))
+	h.Write(u32(0))
+	h.Write(name(dns.HmacSHA256))
+	h.Write(time48(now))
+	h.Write(u16(tsigFudge))
+	h.Write(u16(0))
+	h.Write(u16(0))
+	mac := h.Sum(nil)
+
+	rdata := append(name(dns.HmacSHA256), time48(now)...)
+	rdata = append(rdata, u16(tsigFudge)...)
+	rdata = append(rdata, u16(uint16(len(mac)))...)
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, u16(id)...)
+	rdata = append(rdata, 0, 0, 0, 0)
+	msg[11] = 1 // ARCOUNT
+	msg = append(msg, name(testKeyName)...)
+	msg = append(msg, u16(dns.TypeTSIG)...)
+	msg = append(msg, u16(dns.ClassANY)...)
+	msg = append(msg, u32(0)...)
+	msg = append(msg, u16(uint16(len(rdata)))...)
+	msg = append(msg, rdata...)
+
+	conn, err := net.Dial("udp", s.addr())
+	s.Require().NoError(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Write(msg)
+	s.Require().NoError(err)
+	buf := make([]byte, dns.MinMsgSize)
+	n, err := conn.Read(buf)
+	s.Require().NoError(err)
+
+	rep := new(dns.Msg)
+	s.Require().NoError(rep.Unpack(buf[:n]))
+	s.Equal(dns.RcodeSuccess, rep.Rcode)
+	s.NoError(dns.TsigVerify(buf[:n], testKeySecret, hex.EncodeToString(mac), false))
+	s.Equal([]string{"10.1.1.1", "10.1.1.2"}, s.lookup("host1.corp.net."))
+}
+
+func (s *DNSUpdateTestSuite) Test_updateMsgAcceptFunc() {
+	accept := updateMsgAcceptFunc(dns.DefaultMsgAcceptFunc)
+	header := func (m *dns.Msg) dns.Header {
+		buf, err := m.Pack()
+		s.Require().NoError(err)
+		return dns.Header{
+			Id: m.Id,
+			Bits: uint16(buf[2])<<8 | uint16(buf[3]),
+			Qdcount: uint16(len(m.Question)),
+			Ancount: uint16(len(m.Answer)),
+			Nscount: uint16(len(m.Ns)),
+			Arcount: uint16(len(m.Extra)),
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate("dev.corp.net.")
+	m.Insert(rrs("host1.dev.corp.net. 60 IN A 10.1.1.1", "host1.dev.corp.net. 60 IN A 10.1.1.2"))
+	s.Equal(dns.MsgRejectNotImplemented, dns.DefaultMsgAcceptFunc(header(m)))
+	s.Equal(dns.MsgAccept, accept(header(m)))
+
+	m.Response = true
+	s.Equal(dns.MsgIgnore, accept(header(m)))
+
+	m = new(dns.Msg)
+	m.SetQuestion("host1.dev.corp.net.", dns.TypeA)
+	s.Equal(dns.MsgAccept, accept(header(m)))
+	m.Opcode = dns.OpcodeStatus
+	s.Equal(dns.MsgRejectNotImplemented, accept(header(m)))
+}
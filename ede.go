@@ -0,0 +1,92 @@
+package localstar
+
+// Extended DNS Errors (RFC 8914). The option is not supported by
+// miekg/dns yet, so it is built as a local one.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const optionCodeEDE = 15
+
+// info codes used by the plugin
+const (
+	edeOther                uint16 = 0
+	edeBlocked              uint16 = 15
+	edeProhibited           uint16 = 18
+	edeNoReachableAuthority uint16 = 22
+	edeNetworkError         uint16 = 23
+	edeInvalidData          uint16 = 24
+)
+
+func newEDE(code uint16, text string) *dns.EDNS0_LOCAL {
+	data := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	copy(data[2:], text)
+	return &dns.EDNS0_LOCAL{Code: optionCodeEDE, Data: data}
+}
+
+// parseEDE returns info code and extra text of the option.
+func parseEDE(opt dns.EDNS0) (uint16, string, bool) {
+	local, ok := opt.(*dns.EDNS0_LOCAL)
+	if !ok || local.Code != optionCodeEDE || len(local.Data) < 2 {
+		return 0, "", false
+	}
+	return binary.BigEndian.Uint16(local.Data), string(local.Data[2:]), true
+}
+
+// errorEDE returns info code and description of the error.
+func errorEDE(err error) (uint16, string) {
+	var (
+		netErr net.Error
+		dnsErr *dns.Error
+	)
+	switch {
+	case errors.Is(err, errLoopRequest):
+		return edeProhibited, "loop detected"
+	case errors.Is(err, errACLDenied):
+		return edeProhibited, "denied by ACL"
+	case errors.Is(err, errFilteredAnswer):
+		return edeBlocked, "answer blocked by filter"
+	case errors.Is(err, errRateLimited):
+		return edeOther, "rate limited"
+	case errors.Is(err, errMaxConcurrent):
+		return edeOther, "too many concurrent queries"
+	case errors.Is(err, errQuestionCount), errors.Is(err, errNotImplemented):
+		return edeOther, err.Error()
+	case errors.Is(err, errInvalidResponse), errors.Is(err, errTsigUnsigned), errors.As(err, &dnsErr):
+		return edeInvalidData, "invalid upstream response"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout(),
+		status.Code(err) == codes.DeadlineExceeded:
+		return edeNoReachableAuthority, "upstream timeout"
+	case errors.As(err, &netErr), status.Code(err) == codes.Unavailable:
+		return edeNetworkError, "upstream network error"
+	}
+	return edeOther, ""
+}
+
+// attachEDE adds Extended DNS Error describing err to OPT record of msg,
+// nothing is added if the message has no OPT.
+func (ls LocalStar) attachEDE(msg *dns.Msg, err error, lookupName string) {
+	o := msg.IsEdns0()
+	if o == nil {
+		return
+	}
+	code, text := errorEDE(err)
+	switch {
+	case !ls.edeExtraText:
+		text = ""
+	case lookupName != "" && text != "":
+		text += ": " + lookupName
+	case lookupName != "":
+		text = lookupName
+	}
+	o.Option = append(o.Option, newEDE(code, text))
+}
@@ -0,0 +1,137 @@
+package localstar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type EDETestSuite struct {
+	suite.Suite
+}
+
+func TestEDETestSuite(t *testing.T) {
+	suite.Run(t, new(EDETestSuite))
+}
+
+type timeoutError struct{ timeout bool }
+
+func (e timeoutError) Error() string   { return "i/o error" }
+func (e timeoutError) Timeout() bool   { return e.timeout }
+func (e timeoutError) Temporary() bool { return false }
+
+func (s *EDETestSuite) Test_newEDE() {
+	ede := newEDE(edeBlocked, "blocked")
+	s.EqualValues(optionCodeEDE, ede.Option())
+	s.Equal([]byte{0, 15, 'b', 'l', 'o', 'c', 'k', 'e', 'd'}, ede.Data)
+
+	code, text, ok := parseEDE(ede)
+	s.True(ok)
+	s.Equal(edeBlocked, code)
+	s.Equal("blocked", text)
+
+	_, _, ok = parseEDE(&dns.EDNS0_LOCAL{Code: optionCodeEDE, Data: []byte{0}})
+	s.False(ok)
+	_, _, ok = parseEDE(&dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	s.False(ok)
+}
+
+func (s *EDETestSuite) Test_errorEDE() {
+	opErr := &net.OpError{Op: "read", Net: "udp", Err: timeoutError{true}}
+	for _, tt := range []struct {
+		err  error
+		code uint16
+	}{
+		{errLoopRequest, edeProhibited},
+		{errACLDenied, edeProhibited},
+		{errFilteredAnswer, edeBlocked},
+		{errRateLimited, edeOther},
+		{errMaxConcurrent, edeOther},
+		{errQuestionCount, edeOther},
+		{errNotImplemented, edeOther},
+		{fmt.Errorf("%w: id mismatch", errInvalidResponse), edeInvalidData},
+		{errTsigUnsigned, edeInvalidData},
+		{dns.ErrSig, edeInvalidData},
+		{context.DeadlineExceeded, edeNoReachableAuthority},
+		{opErr, edeNoReachableAuthority},
+		{&net.OpError{Op: "read", Net: "udp", Err: timeoutError{false}}, edeNetworkError},
+		{errors.New("other"), edeOther},
+	}{
+		code, _ := errorEDE(tt.err)
+		s.Equal(tt.code, code, tt.err.Error())
+	}
+}
+
+func (s *EDETestSuite) Test_attachEDE() {
+	msg := new(dns.Msg)
+	ls := LocalStar{}
+	ls.attachEDE(msg, errLoopRequest, "")
+	s.Empty(msg.Extra)
+
+	ede := func (msg *dns.Msg) (uint16, string) {
+		o := msg.IsEdns0()
+		s.Require().NotNil(o)
+		s.Require().Len(o.Option, 1)
+		code, text, ok := parseEDE(o.Option[0])
+		s.Require().True(ok)
+		return code, text
+	}
+
+	msg = new(dns.Msg)
+	msg.SetEdns0(ednsUDPSize, false)
+	ls.attachEDE(msg, errFilteredAnswer, "host1.corp.net.")
+	code, text := ede(msg)
+	s.Equal(edeBlocked, code)
+	s.Equal("", text)
+
+	ls.edeExtraText = true
+	msg = new(dns.Msg)
+	msg.SetEdns0(ednsUDPSize, false)
+	ls.attachEDE(msg, errFilteredAnswer, "host1.corp.net.")
+	_, text = ede(msg)
+	s.Equal("answer blocked by filter: host1.corp.net.", text)
+
+	msg = new(dns.Msg)
+	msg.SetEdns0(ednsUDPSize, false)
+	ls.attachEDE(msg, errors.New("other"), "host1.corp.net.")
+	_, text = ede(msg)
+	s.Equal("host1.corp.net.", text)
+}
+
+func (s *EDETestSuite) Test_serveError() {
+	ls := LocalStar{edeExtraText: true}
+
+	// no EDE for clients without EDNS
+	req := new(dns.Msg)
+	req.SetQuestion("host1.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := ls.serveError(rec, req, errLoopRequest, "")
+	s.Equal(dns.RcodeSuccess, rcode)
+	s.Equal(errLoopRequest, err)
+	if s.NotNil(rec.Msg) {
+		s.Equal(dns.RcodeRefused, rec.Msg.Rcode)
+		s.Empty(rec.Msg.Extra)
+	}
+
+	req.SetEdns0(4096, true)
+	rcode, err = ls.serveError(rec, req, context.DeadlineExceeded, "host1.corp.net.")
+	s.Equal(dns.RcodeSuccess, rcode)
+	s.Equal(context.DeadlineExceeded, err)
+	if s.NotNil(rec.Msg) {
+		s.Equal(dns.RcodeServerFailure, rec.Msg.Rcode)
+		s.Equal(req.Id, rec.Msg.Id)
+		if o := rec.Msg.IsEdns0(); s.NotNil(o) && s.Len(o.Option, 1) {
+			s.True(o.Do())
+			code, text, _ := parseEDE(o.Option[0])
+			s.Equal(edeNoReachableAuthority, code)
+			s.Equal("upstream timeout: host1.corp.net.", text)
+		}
+	}
+}
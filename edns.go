@@ -0,0 +1,141 @@
+package localstar
+
+// EDNS0 policy for upstream queries and replies to clients.
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the buffer size advertised to upstreams and clients.
+const ednsUDPSize = 1232
+
+const (
+	defaultECSPrefixV4 = 24
+	defaultECSPrefixV6 = 56
+)
+
+// ecsMode defines what is sent upstream as EDNS Client Subnet.
+type ecsMode int
+
+const (
+	ecsStrip      ecsMode = iota // never send ECS
+	ecsForward                   // send ECS of the client request as is
+	ecsSynthesize                // send ECS built from the client address
+)
+
+var ecsModes = map[string]ecsMode{
+	"strip":      ecsStrip,
+	"forward":    ecsForward,
+	"synthesize": ecsSynthesize,
+}
+
+type ednsPolicy struct {
+	ecs      ecsMode
+	prefixV4 uint8 // source prefix length of synthesized ECS
+	prefixV6 uint8
+}
+
+func newEDNSPolicy() ednsPolicy {
+	return ednsPolicy{prefixV4: defaultECSPrefixV4, prefixV6: defaultECSPrefixV6}
+}
+
+// prepareRequest replaces OPT record of msg, a copy of the client request,
+// with a normalized one. Only DO bit and ECS (according to the policy) are
+// taken from the client, other options (cookies, padding, etc.) are dropped.
+func (p ednsPolicy) prepareRequest(msg *dns.Msg, clientIP net.IP) {
+	clientOpt := msg.IsEdns0()
+	msg.Extra = stripOPT(msg.Extra)
+
+	o := newOPT()
+	if clientOpt != nil && clientOpt.Do() {
+		o.SetDo()
+	}
+	clientECS := findECS(clientOpt)
+	switch {
+	case p.ecs == ecsForward && clientECS != nil:
+		o.Option = append(o.Option, clientECS)
+	case p.ecs == ecsSynthesize && clientECS != nil && clientECS.SourceNetmask == 0:
+		// the client asked not to reveal its address
+		o.Option = append(o.Option, clientECS)
+	case p.ecs == ecsSynthesize && clientIP != nil:
+		o.Option = append(o.Option, p.synthesizeECS(clientIP))
+	}
+	msg.Extra = append(msg.Extra, o)
+}
+
+// prepareReply replaces OPT record of the upstream response with one the
+// client supports: there is no OPT if the client did not send it, ECS is
+// returned only to clients which sent it.
+func (p ednsPolicy) prepareReply(req, res *dns.Msg) {
+	resECS := findECS(res.IsEdns0())
+	res.Extra = stripOPT(res.Extra)
+
+	clientOpt := req.IsEdns0()
+	if clientOpt == nil {
+		return
+	}
+	o := newOPT()
+	if clientOpt.Do() {
+		o.SetDo()
+	}
+	if clientECS := findECS(clientOpt); clientECS != nil {
+		ecs := *clientECS
+		ecs.SourceScope = 0
+		// scope is meaningful only for the subnet sent upstream
+		if resECS != nil && sameSubnet(clientECS, resECS) {
+			ecs.SourceScope = resECS.SourceScope
+		}
+		o.Option = append(o.Option, &ecs)
+	}
+	res.Extra = append(res.Extra, o)
+}
+
+func (p ednsPolicy) synthesizeECS(ip net.IP) *dns.EDNS0_SUBNET {
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.SourceNetmask = p.prefixV4
+		ecs.Address = ip4.Mask(net.CIDRMask(int(p.prefixV4), net.IPv4len*8))
+	} else {
+		ecs.Family = 2
+		ecs.SourceNetmask = p.prefixV6
+		ecs.Address = ip.Mask(net.CIDRMask(int(p.prefixV6), net.IPv6len*8))
+	}
+	return ecs
+}
+
+func newOPT() *dns.OPT {
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	o.SetUDPSize(ednsUDPSize)
+	return o
+}
+
+// stripOPT removes OPT records, TSIG is removed as well as it must be the
+// last record and signs the original message only.
+func stripOPT(rrs []dns.RR) []dns.RR {
+	var res []dns.RR
+	for _, rr := range rrs {
+		if t := rr.Header().Rrtype; t != dns.TypeOPT && t != dns.TypeTSIG {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+func findECS(o *dns.OPT) *dns.EDNS0_SUBNET {
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if ecs, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+func sameSubnet(a, b *dns.EDNS0_SUBNET) bool {
+	return a.Family == b.Family && a.SourceNetmask == b.SourceNetmask && a.Address.Equal(b.Address)
+}
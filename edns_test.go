@@ -0,0 +1,211 @@
+package localstar
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type EDNSTestSuite struct {
+	suite.Suite
+}
+
+func TestEDNSTestSuite(t *testing.T) {
+	suite.Run(t, new(EDNSTestSuite))
+}
+
+// clientMsg returns a query with OPT record carrying the options.
+func (s *EDNSTestSuite) clientMsg(size uint16, do bool, options ...dns.EDNS0) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	msg.SetEdns0(size, do)
+	o := msg.IsEdns0()
+	o.Option = append(o.Option, options...)
+	return msg
+}
+
+func ecsOption(family uint16, netmask uint8, addr string) *dns.EDNS0_SUBNET {
+	return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: netmask, Address: net.ParseIP(addr)}
+}
+
+func (s *EDNSTestSuite) Test_prepareRequest() {
+	cookie := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"}
+	padding := &dns.EDNS0_PADDING{Padding: make([]byte, 16)}
+	ecs := ecsOption(1, 24, "192.0.2.0")
+	clientIP := net.ParseIP("10.1.2.3")
+
+	// buffer size is normalized, DO is kept, unknown options are dropped
+	msg := s.clientMsg(4096, true, cookie, padding)
+	newEDNSPolicy().prepareRequest(msg, clientIP)
+	o := msg.IsEdns0()
+	if s.NotNil(o) {
+		s.Len(msg.Extra, 1)
+		s.EqualValues(ednsUDPSize, o.UDPSize())
+		s.True(o.Do())
+		s.Empty(o.Option)
+	}
+
+	// OPT is added for clients without EDNS
+	msg = new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	newEDNSPolicy().prepareRequest(msg, clientIP)
+	if o = msg.IsEdns0(); s.NotNil(o) {
+		s.EqualValues(ednsUDPSize, o.UDPSize())
+		s.False(o.Do())
+	}
+
+	// ECS is stripped by default
+	msg = s.clientMsg(512, false, ecs, cookie)
+	newEDNSPolicy().prepareRequest(msg, clientIP)
+	s.Nil(findECS(msg.IsEdns0()))
+
+	// ECS of the client is forwarded
+	policy := newEDNSPolicy()
+	policy.ecs = ecsForward
+	msg = s.clientMsg(512, false, ecs, cookie)
+	policy.prepareRequest(msg, clientIP)
+	if o = msg.IsEdns0(); s.NotNil(o) {
+		s.Equal([]dns.EDNS0{ecs}, o.Option)
+	}
+	msg = s.clientMsg(512, false)
+	policy.prepareRequest(msg, clientIP)
+	s.Nil(findECS(msg.IsEdns0()))
+
+	// ECS is synthesized from the client address
+	policy.ecs = ecsSynthesize
+	msg = s.clientMsg(512, false, ecs)
+	policy.prepareRequest(msg, clientIP)
+	if got := findECS(msg.IsEdns0()); s.NotNil(got) {
+		s.EqualValues(1, got.Family)
+		s.EqualValues(24, got.SourceNetmask)
+		s.Equal("10.1.2.0", got.Address.String())
+	}
+	msg = s.clientMsg(512, false)
+	policy.prepareRequest(msg, net.ParseIP("fd00:1:2:3:4::1"))
+	if got := findECS(msg.IsEdns0()); s.NotNil(got) {
+		s.EqualValues(2, got.Family)
+		s.EqualValues(56, got.SourceNetmask)
+		s.Equal("fd00:1:2::", got.Address.String())
+	}
+	// clients may opt out with zero source prefix
+	optOut := ecsOption(1, 0, "0.0.0.0")
+	msg = s.clientMsg(512, false, optOut)
+	policy.prepareRequest(msg, clientIP)
+	s.Equal(optOut, findECS(msg.IsEdns0()))
+
+	// TSIG of the client is not passed upstream
+	msg = s.clientMsg(512, false)
+	msg.SetTsig("key1.", dns.HmacSHA256, tsigFudge, 0)
+	policy.prepareRequest(msg, clientIP)
+	s.Nil(msg.IsTsig())
+	s.NotNil(msg.IsEdns0())
+}
+
+func (s *EDNSTestSuite) Test_prepareReply() {
+	policy := newEDNSPolicy()
+	upstream := func (options ...dns.EDNS0) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetEdns0(4096, true)
+		o := res.IsEdns0()
+		o.Option = append(o.Option, options...)
+		o.Option = append(o.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e73"})
+		return res
+	}
+
+	// no OPT for clients without EDNS
+	req := new(dns.Msg)
+	req.SetQuestion("host1.corp.net.", dns.TypeA)
+	res := upstream()
+	policy.prepareReply(req, res)
+	s.Nil(res.IsEdns0())
+	s.Empty(res.Extra)
+
+	// OPT of the reply reflects the client one
+	req = s.clientMsg(512, false, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	res = upstream()
+	policy.prepareReply(req, res)
+	if o := res.IsEdns0(); s.NotNil(o) && s.Len(res.Extra, 1) {
+		s.EqualValues(ednsUDPSize, o.UDPSize())
+		s.False(o.Do())
+		s.Empty(o.Option)
+	}
+
+	// scope of forwarded ECS is returned
+	ecs := ecsOption(1, 24, "192.0.2.0")
+	resECS := ecsOption(1, 24, "192.0.2.0")
+	resECS.SourceScope = 16
+	req = s.clientMsg(512, true, ecs)
+	res = upstream(resECS)
+	policy.prepareReply(req, res)
+	if o := res.IsEdns0(); s.NotNil(o) {
+		s.True(o.Do())
+		if got := findECS(o); s.NotNil(got) {
+			s.EqualValues(16, got.SourceScope)
+			s.Equal("192.0.2.0", got.Address.String())
+		}
+	}
+
+	// ECS for other subnet is not exposed to the client
+	res = upstream(ecsOption(1, 24, "10.1.2.0"))
+	policy.prepareReply(req, res)
+	if got := findECS(res.IsEdns0()); s.NotNil(got) {
+		s.EqualValues(0, got.SourceScope)
+		s.Equal("192.0.2.0", got.Address.String())
+	}
+	req = s.clientMsg(512, false)
+	res = upstream(ecsOption(1, 24, "10.1.2.0"))
+	policy.prepareReply(req, res)
+	s.Nil(findECS(res.IsEdns0()))
+}
+
+func (s *EDNSTestSuite) Test_lookupOnExternalDNS() {
+	var sent *dns.Msg
+	ls := LocalStar{
+		edns: newEDNSPolicy(),
+		provider: &stubDNSProvider{exchangeCb: func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+			sent = msg
+			res := new(dns.Msg)
+			res.SetReply(msg)
+			for i := 0; i < 50; i++ {
+				res.Answer = append(res.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A: net.IPv4(10, 1, 1, byte(i)),
+				})
+			}
+			res.SetEdns0(4096, false)
+			return res, nil
+		}},
+	}
+	lookup := func (req *dns.Msg) *dns.Msg {
+		state := &request.Request{W: &test.ResponseWriter{}, Req: req}
+		res, err := ls.lookupOnExternalDNS(context.Background(), "host1.corp.net.", "host1.example.com.", state)
+		s.Require().NoError(err)
+		return res
+	}
+
+	// the answer doesn't fit into 512 bytes of the client without EDNS
+	req := new(dns.Msg)
+	req.SetQuestion("host1.example.com.", dns.TypeA)
+	res := lookup(req)
+	if s.NotNil(sent.IsEdns0()) {
+		s.EqualValues(ednsUDPSize, sent.IsEdns0().UDPSize())
+	}
+	s.Nil(res.IsEdns0())
+	s.True(res.Truncated)
+	s.LessOrEqual(res.Len(), dns.MinMsgSize)
+
+	req = new(dns.Msg)
+	req.SetQuestion("host1.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	res = lookup(req)
+	s.False(res.Truncated)
+	s.Len(res.Answer, 50)
+	if s.NotNil(res.IsEdns0()) {
+		s.EqualValues(ednsUDPSize, res.IsEdns0().UDPSize())
+	}
+}
@@ -0,0 +1,152 @@
+package localstar
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// fakeServer is an in-process DNS server on UDP and TCP for tests, it
+// answers from records or with handler, faults are applied to every query.
+type fakeServer struct {
+	addr       string
+	records    []dns.RR
+	handler    dns.HandlerFunc // replaces records if set
+	tsigSecret map[string]string
+
+	mu       sync.Mutex
+	faults   fakeFaults
+	queries  int32
+	udp, tcp *dns.Server
+}
+
+// fakeFaults are failures injected by fakeServer.
+type fakeFaults struct {
+	delay    time.Duration // before responding
+	drop     bool          // no response
+	truncate bool          // empty response with TC bit over UDP
+	wrongID  bool
+	rcode    int // replaces rcode of response if set
+}
+
+// startFakeServer starts fakeServer with records in zone file format,
+// it is stopped on the test cleanup.
+func startFakeServer(t *testing.T, records ...string) *fakeServer {
+	f := new(fakeServer)
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("invalid record %q: %s", s, err)
+		}
+		f.records = append(f.records, rr)
+	}
+	f.start(t)
+	return f
+}
+
+// start listens on the same random port for UDP and TCP.
+func (f *fakeServer) start(t *testing.T) {
+	var (pc net.PacketConn; l net.Listener; err error)
+	for i := 0; i < 10; i++ {
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.addr = pc.LocalAddr().String()
+	f.udp = &dns.Server{PacketConn: pc, Handler: f, TsigSecret: f.tsigSecret}
+	f.tcp = &dns.Server{Listener: l, Handler: f, TsigSecret: f.tsigSecret}
+	for _, server := range []*dns.Server{f.udp, f.tcp} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func () { close(started) }
+		go server.ActivateAndServe()
+		<-started
+	}
+	t.Cleanup(f.stop)
+}
+
+func (f *fakeServer) stop() {
+	f.udp.Shutdown()
+	f.tcp.Shutdown()
+}
+
+func (f *fakeServer) setFaults(faults fakeFaults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = faults
+}
+
+// calls returns number of received queries.
+func (f *fakeServer) calls() int {
+	return int(atomic.LoadInt32(&f.queries))
+}
+
+func (f *fakeServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	atomic.AddInt32(&f.queries, 1)
+	f.mu.Lock()
+	faults := f.faults
+	f.mu.Unlock()
+
+	if faults.delay > 0 {
+		time.Sleep(faults.delay)
+	}
+	if faults.drop {
+		return
+	}
+	if f.handler != nil {
+		f.handler(w, req)
+		return
+	}
+	res := f.answer(req)
+	// as real servers do, UDP responses fit the buffer of the request
+	res.Truncate((&request.Request{W: w, Req: req}).Size())
+	if faults.truncate && w.LocalAddr().Network() == "udp" {
+		res.Truncated = true
+		res.Answer, res.Ns, res.Extra = nil, nil, nil
+	}
+	if faults.wrongID {
+		res.Id++
+	}
+	if faults.rcode != dns.RcodeSuccess {
+		res.Rcode = faults.rcode
+	}
+	w.WriteMsg(res)
+}
+
+// answer makes an authoritative response from records.
+func (f *fakeServer) answer(req *dns.Msg) *dns.Msg {
+	res := new(dns.Msg)
+	if len(req.Question) != 1 {
+		return res.SetRcode(req, dns.RcodeFormatError)
+	}
+	res.SetReply(req)
+	res.Authoritative = true
+	q, found := req.Question[0], false
+	for _, rr := range f.records {
+		if !strings.EqualFold(rr.Header().Name, q.Name) {
+			continue
+		}
+		found = true
+		if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			res.Answer = append(res.Answer, rr)
+		}
+	}
+	if !found {
+		res.Rcode = dns.RcodeNameError
+	}
+	return res
+}
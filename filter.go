@@ -0,0 +1,109 @@
+package localstar
+
+// Filter of addresses in translated answers, protects from DNS rebinding.
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+type filterAction int
+
+const (
+	filterDrop filterAction = iota // remove blocked records from the answer
+	filterNXDomain
+	filterRefused
+)
+
+var errFilteredAnswer = errors.New("answer blocked by filter")
+
+var filterActions = map[string]filterAction{
+	"drop":     filterDrop,
+	"nxdomain": filterNXDomain,
+	"refused":  filterRefused,
+}
+
+// privateNets are RFC 1918 and RFC 4193 (ULA) networks.
+var privateNets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+type addrFilter struct {
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	action filterAction
+}
+
+func (a filterAction) String() string {
+	for name, action := range filterActions {
+		if action == a {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// parseNets parses CIDRs and plain addresses, "private" expands
+// to privateNets.
+func parseNets(args []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, arg := range args {
+		if arg == "private" {
+			n, _ := parseNets(privateNets)
+			nets = append(nets, n...)
+			continue
+		}
+		if ip := net.ParseIP(arg); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *addrFilter) allowed(ip net.IP) bool {
+	if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+		return false
+	}
+	return !containsIP(f.deny, ip)
+}
+
+// apply removes A and AAAA records with blocked addresses from the answer
+// and additional sections, the latter may carry glue for MX, SRV or NS
+// answers. It returns numbers of records removed from each section.
+func (f *addrFilter) apply(res *dns.Msg) (answer, extra int) {
+	res.Answer, answer = f.filterRRs(res.Answer)
+	res.Extra, extra = f.filterRRs(res.Extra)
+	return answer, extra
+}
+
+func (f *addrFilter) filterRRs(rrs []dns.RR) ([]dns.RR, int) {
+	blocked := 0
+	res := rrs[:0]
+	for _, rr := range rrs {
+		if ip := rrIP(rr); ip != nil && !f.allowed(ip) {
+			blocked++
+			continue
+		}
+		res = append(res, rr)
+	}
+	return res, blocked
+}
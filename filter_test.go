@@ -0,0 +1,108 @@
+package localstar
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type FilterTestSuite struct {
+	suite.Suite
+}
+
+func TestFilterTestSuite(t *testing.T) {
+	suite.Run(t, new(FilterTestSuite))
+}
+
+func (s *FilterTestSuite) Test_parseNets() {
+	nets, err := parseNets([]string{"10.1.1.1", "fd00::1", "192.168.0.0/16", "private"})
+	if s.NoError(err) {
+		var res []string
+		for _, n := range nets {
+			res = append(res, n.String())
+		}
+		s.Equal([]string{
+			"10.1.1.1/32", "fd00::1/128", "192.168.0.0/16",
+			"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+		}, res)
+	}
+
+	_, err = parseNets([]string{"10.1.1.1/33"})
+	s.Error(err)
+	_, err = parseNets([]string{"host1"})
+	s.Error(err)
+}
+
+func (s *FilterTestSuite) Test_allowed() {
+	allow, _ := parseNets([]string{"private"})
+	deny, _ := parseNets([]string{"10.10.0.0/16", "fd00::1"})
+
+	for _, t := range []struct {
+		filter addrFilter
+		ip string
+		allowed bool
+	}{
+		{addrFilter{}, "8.8.8.8", true},
+		{addrFilter{allow: allow}, "8.8.8.8", false},
+		{addrFilter{allow: allow}, "10.1.1.1", true},
+		{addrFilter{allow: allow}, "172.20.1.1", true},
+		{addrFilter{allow: allow}, "fd00::2", true},
+		{addrFilter{allow: allow}, "2001:db8::1", false},
+		{addrFilter{allow: allow}, "::ffff:10.1.1.1", true},
+		{addrFilter{deny: deny}, "8.8.8.8", true},
+		{addrFilter{deny: deny}, "10.10.1.1", false},
+		{addrFilter{allow: allow, deny: deny}, "10.1.1.1", true},
+		{addrFilter{allow: allow, deny: deny}, "10.10.1.1", false},
+		{addrFilter{allow: allow, deny: deny}, "fd00::1", false},
+	}{
+		s.Equal(t.allowed, t.filter.allowed(net.ParseIP(t.ip)), t)
+	}
+}
+
+func (s *FilterTestSuite) Test_apply() {
+	allow, _ := parseNets([]string{"private"})
+	f := &addrFilter{allow: allow}
+	res := &dns.Msg{Answer: []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "host1.corp.net.", Rrtype: dns.TypeCNAME}, Target: "host.corp.net."},
+		&dns.A{Hdr: dns.RR_Header{Name: "host.corp.net.", Rrtype: dns.TypeA}, A: net.ParseIP("10.1.1.1")},
+		&dns.A{Hdr: dns.RR_Header{Name: "host.corp.net.", Rrtype: dns.TypeA}, A: net.ParseIP("8.8.8.8")},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "host.corp.net.", Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("2001:db8::1")},
+	}}
+	answer, extra := f.apply(res)
+	s.Equal(2, answer)
+	s.Equal(0, extra)
+	if s.Len(res.Answer, 2) {
+		s.IsType(&dns.CNAME{}, res.Answer[0])
+		s.Equal("10.1.1.1", rrIP(res.Answer[1]).String())
+	}
+	answer, _ = f.apply(res)
+	s.Equal(0, answer)
+	s.Len(res.Answer, 2)
+}
+
+func (s *FilterTestSuite) Test_apply_extra() {
+	allow, _ := parseNets([]string{"private"})
+	f := &addrFilter{allow: allow}
+	opt := new(dns.OPT)
+	opt.Hdr = dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}
+	res := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.MX{Hdr: dns.RR_Header{Name: "host1.corp.net.", Rrtype: dns.TypeMX}, Preference: 10, Mx: "mail.corp.net."},
+		},
+		Extra: []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "mail.corp.net.", Rrtype: dns.TypeA}, A: net.ParseIP("8.8.8.8")},
+			&dns.A{Hdr: dns.RR_Header{Name: "mail.corp.net.", Rrtype: dns.TypeA}, A: net.ParseIP("10.1.1.1")},
+			opt,
+		},
+	}
+	answer, extra := f.apply(res)
+	s.Equal(0, answer)
+	s.Equal(1, extra)
+	s.Len(res.Answer, 1)
+	if s.Len(res.Extra, 2) {
+		s.Equal("10.1.1.1", rrIP(res.Extra[0]).String())
+		s.Equal(opt, res.Extra[1])
+	}
+}
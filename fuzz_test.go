@@ -0,0 +1,107 @@
+//go:build go1.18
+// +build go1.18
+
+package localstar
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func FuzzCalcZoneDiff(f *testing.F) {
+	f.Add("dev.corp.net.", "corp.net.")
+	f.Add("corp.net.", "dev.corp.net.")
+	f.Add(".", ".")
+	f.Add("net.", ".")
+	f.Fuzz(func (t *testing.T, from, to string) {
+		diff := calcZoneDiff(from, to)
+		if diff != "" && diff + to != from {
+			t.Errorf("calcZoneDiff(%q, %q) = %q", from, to, diff)
+		}
+	})
+}
+
+func FuzzGetLookupName(f *testing.F) {
+	f.Add("dev.corp.net.", "corp.net.", 1, "host.dev.corp.net.")
+	f.Add("dev.corp.net.", "corp.net.", 2, "a.host.dev.dev.corp.net.")
+	f.Add("dev.corp.net.", "corp.net.", 1, "dev.corp.net.")
+	f.Add("dev.corp.net.", "corp.net.", 1, ".")
+	f.Add(".", "corp.net.", 1, "host.net.")
+	f.Add("dev.corp.net.", ".", 1, "host.dev.corp.net.")
+	f.Fuzz(func (t *testing.T, from, to string, prefixLen int, qname string) {
+		// zones are normalized by setup
+		from, to = strings.ToLower(dns.Fqdn(from)), strings.ToLower(dns.Fqdn(to))
+		ls := LocalStar{fromZone: from, toZone: to, prefixLen: prefixLen, toZoneDiff: calcZoneDiff(from, to)}
+		lname, err := ls.getLookupName(qname)
+		if err != nil {
+			return
+		}
+		if !strings.HasSuffix(lname, to) {
+			t.Errorf("getLookupName(%q) = %q is not in %q", qname, lname, to)
+		}
+		if prefixLen > 0 && dns.CountLabel(lname) > dns.CountLabel(to) + prefixLen {
+			t.Errorf("getLookupName(%q) = %q has more than %d labels in prefix", qname, lname, prefixLen)
+		}
+	})
+}
+
+func FuzzServeDNS(f *testing.F) {
+	for _, q := range []struct{ name string; qtype uint16 }{
+		{"host1.dev.corp.net.", dns.TypeA},
+		{"host1.dev.dev.corp.net.", dns.TypeAAAA},
+		{"dev.corp.net.", dns.TypeSOA},
+		{".", dns.TypeNS},
+	}{
+		req := new(dns.Msg)
+		req.SetQuestion(q.name, q.qtype)
+		req.SetEdns0(1232, true)
+		buf, _ := req.Pack()
+		f.Add(buf)
+	}
+	req := new(dns.Msg)
+	req.Question = []dns.Question{
+		{Name: "host1.dev.corp.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "host2.dev.corp.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+	buf, _ := req.Pack()
+	f.Add(buf)
+	buf, _ = new(dns.Msg).Pack()
+	f.Add(buf)
+
+	ls := LocalStar{
+		fromZone: "dev.corp.net.",
+		toZone: "corp.net.",
+		toZoneDiff: calcZoneDiff("dev.corp.net.", "corp.net."),
+		prefixLen: 1,
+		randomizeCase: true,
+		edns: newEDNSPolicy(),
+		next: test.NextHandler(dns.RcodeSuccess, nil),
+	}
+	// upstream echoes the question with an answer for it
+	ls.provider = &stubDNSProvider{exchangeCb: func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		res := new(dns.Msg)
+		res.SetReply(msg)
+		for _, q := range msg.Question {
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A: net.ParseIP("10.1.1.1"),
+			})
+		}
+		return res, nil
+	}}
+
+	f.Fuzz(func (t *testing.T, buf []byte) {
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			return
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ls.ServeDNS(context.Background(), rec, req)
+	})
+}
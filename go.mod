@@ -6,5 +6,8 @@ require (
 	github.com/coredns/caddy v1.1.0
 	github.com/coredns/coredns v1.8.3
 	github.com/miekg/dns v1.1.40
+	github.com/prometheus/client_golang v1.9.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	google.golang.org/grpc v1.29.1
 )
@@ -0,0 +1,81 @@
+package localstar
+
+// Upstream provider speaking CoreDNS DnsService gRPC protocol.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"time"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var errNotStarted = errors.New("provider is not started")
+
+// grpcDNSProvider sends queries to a grpc endpoint, the connection is
+// established by start and reused for all queries.
+type grpcDNSProvider struct {
+	addr      string
+	timeout   time.Duration
+	tlsConfig *tls.Config // plain text connection if nil
+
+	conn   *grpc.ClientConn
+	client pb.DnsServiceClient
+}
+
+func newGRPCDNSProvider(addr string, timeout time.Duration, tlsConfig *tls.Config) *grpcDNSProvider {
+	return &grpcDNSProvider{addr: addr, timeout: timeout, tlsConfig: tlsConfig}
+}
+
+// Exchange sends msg to the endpoint.
+func (p *grpcDNSProvider) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if p.client == nil {
+		return nil, errNotStarted
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	reply, err := p.client.Query(ctx, &pb.DnsPacket{Msg: buf})
+	if err != nil {
+		return nil, err
+	}
+	res := new(dns.Msg)
+	if err = res.Unpack(reply.Msg); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// start implements runnable and dials the endpoint, dialing is non-blocking,
+// the connection is made in background.
+func (p *grpcDNSProvider) start() error {
+	if p.conn != nil {
+		return nil
+	}
+	opt := grpc.WithInsecure()
+	if p.tlsConfig != nil {
+		opt = grpc.WithTransportCredentials(credentials.NewTLS(p.tlsConfig))
+	}
+	conn, err := grpc.Dial(p.addr, opt)
+	if err != nil {
+		return err
+	}
+	p.conn, p.client = conn, pb.NewDnsServiceClient(conn)
+	return nil
+}
+
+// stop implements runnable and closes the connection, queries on the
+// instance being reloaded fail instead of using a released client.
+func (p *grpcDNSProvider) stop() error {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
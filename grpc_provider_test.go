@@ -0,0 +1,182 @@
+package localstar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type GRPCDNSProviderTestSuite struct {
+	suite.Suite
+}
+
+func TestGRPCDNSProviderTestSuite(t *testing.T) {
+	suite.Run(t, new(GRPCDNSProviderTestSuite))
+}
+
+// dnsService is an in-process DnsService, msg is nil for failing queries.
+type dnsService struct {
+	calls  int32
+	handle func(req *dns.Msg) *dns.Msg
+}
+
+func (d *dnsService) Query(ctx context.Context, in *pb.DnsPacket) (*pb.DnsPacket, error) {
+	atomic.AddInt32(&d.calls, 1)
+	req := new(dns.Msg)
+	if err := req.Unpack(in.Msg); err != nil {
+		return nil, err
+	}
+	res := d.handle(req)
+	if res == nil {
+		return nil, errors.New("query failed")
+	}
+	buf, err := res.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DnsPacket{Msg: buf}, nil
+}
+
+// startGRPCServer starts in-process DnsService server and returns its address.
+func startGRPCServer(t *testing.T, svc *dnsService) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pb.RegisterDnsServiceServer(server, svc)
+	go server.Serve(l)
+	return l.Addr().String(), server.Stop
+}
+
+func (s *GRPCDNSProviderTestSuite) startServer(svc *dnsService) (string, func()) {
+	return startGRPCServer(s.T(), svc)
+}
+
+func (s *GRPCDNSProviderTestSuite) Test_exchange() {
+	good := &dnsService{handle: func (req *dns.Msg) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A: net.ParseIP("10.1.1.1"),
+		})
+		return res
+	}}
+	goodAddr, stopGood := s.startServer(good)
+	defer stopGood()
+	failing := &dnsService{handle: func (req *dns.Msg) *dns.Msg { return nil }}
+	failingAddr, stopFailing := s.startServer(failing)
+	defer stopFailing()
+	invalid := &dnsService{handle: func (req *dns.Msg) *dns.Msg {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Id++
+		return res
+	}}
+	invalidAddr, stopInvalid := s.startServer(invalid)
+	defer stopInvalid()
+
+	exchange := func (addr string) (*dns.Msg, error) {
+		p := newGRPCDNSProvider(addr, 1 * time.Second, nil)
+		s.Require().NoError(p.start())
+		defer p.stop()
+		msg := new(dns.Msg)
+		msg.SetQuestion("host1.corp.net.", dns.TypeA)
+		return p.Exchange(context.Background(), msg)
+	}
+
+	res, err := exchange(goodAddr)
+	if s.NoError(err) && s.NotNil(res) && s.Len(res.Answer, 1) {
+		s.Equal("10.1.1.1", res.Answer[0].(*dns.A).A.String())
+	}
+	res, err = exchange(failingAddr)
+	s.Nil(res)
+	s.Error(err)
+	// responses are validated by compositeDNSProvider
+	res, err = exchange(invalidAddr)
+	s.NoError(err)
+	s.NotNil(res)
+
+	p := new(compositeDNSProvider)
+	s.Require().NoError(p.Init([]string{"grpc://" + failingAddr, "grpc://" + invalidAddr, "grpc://" + goodAddr}, 1 * time.Second))
+	s.Require().NoError(p.start())
+	defer p.stop()
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	res, err = p.Exchange(context.Background(), msg)
+	if s.NoError(err) && s.NotNil(res) {
+		s.Len(res.Answer, 1)
+	}
+	s.EqualValues(2, atomic.LoadInt32(&failing.calls))
+	s.EqualValues(2, atomic.LoadInt32(&invalid.calls))
+	s.EqualValues(2, atomic.LoadInt32(&good.calls))
+}
+
+func (s *GRPCDNSProviderTestSuite) Test_exchange_timeout() {
+	svc := &dnsService{handle: func (req *dns.Msg) *dns.Msg {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	}}
+	addr, stop := s.startServer(svc)
+	defer stop()
+
+	p := newGRPCDNSProvider(addr, 50 * time.Millisecond, nil)
+	s.Require().NoError(p.start())
+	defer p.stop()
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	start := time.Now()
+	res, err := p.Exchange(context.Background(), msg)
+	s.Nil(res)
+	s.Error(err)
+	s.Less(int64(time.Since(start)), int64(150 * time.Millisecond))
+	code, _ := errorEDE(err)
+	s.Equal(edeNoReachableAuthority, code)
+}
+
+func (s *GRPCDNSProviderTestSuite) Test_start_stop() {
+	release := make(chan struct{})
+	svc := &dnsService{handle: func (req *dns.Msg) *dns.Msg {
+		<-release
+		res := new(dns.Msg)
+		res.SetReply(req)
+		return res
+	}}
+	addr, stop := s.startServer(svc)
+	defer stop()
+	defer close(release)
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+
+	// the endpoint is dialed by start
+	p := newGRPCDNSProvider(addr, time.Second, nil)
+	s.Nil(p.conn)
+	_, err := p.Exchange(context.Background(), msg)
+	s.Equal(errNotStarted, err)
+	s.Require().NoError(p.start())
+	s.NotNil(p.conn)
+
+	// queries in progress and later ones fail once the provider is stopped
+	done := make(chan error)
+	go func () {
+		_, err := p.Exchange(context.Background(), msg)
+		done <- err
+	}()
+	for atomic.LoadInt32(&svc.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.NoError(p.stop())
+	s.Error(<-done)
+	_, err = p.Exchange(context.Background(), msg)
+	s.Equal(codes.Canceled, status.Code(err))
+}
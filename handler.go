@@ -4,8 +4,10 @@ package localstar
 
 import (
 	"context"
+	"net"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
@@ -13,34 +15,149 @@ import (
 // Name implements the plugin.Handler interface.
 func (ls LocalStar) Name() string { return name }
 
+// Ready implements the ready.Readiness interface, the plugin is not ready
+// when all endpoints are unhealthy.
+func (ls LocalStar) Ready() bool {
+	if h, ok := ls.provider.(healthReporter); ok {
+		return h.healthy()
+	}
+	return true
+}
+
 // ServeDNS implements the plugin.Handler interface.
 func (ls LocalStar) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (int, error) {
 	next := func() (int, error) {
 		return plugin.NextOrFailure(ls.Name(), ls.next, ctx, w, req)
 	}
 	state := &request.Request{W: w, Req: req}
+	if ls.acl != nil && !ls.acl.allowed(net.ParseIP(state.IP()), state.QType()) {
+		if ls.acl.drop {
+			return dns.RcodeSuccess, nil
+		}
+		return ls.serveError(w, req, errACLDenied, "")
+	}
+
+	switch {
+	case req.Opcode != dns.OpcodeQuery:
+		return ls.serveError(w, req, errNotImplemented, "")
+	case len(req.Question) != 1:
+		return ls.serveError(w, req, errQuestionCount, "")
+	}
+
 	if state.QClass() != dns.ClassINET {
 		return next()
 	}
 
+	if ls.reverse {
+		return ls.serveReverse(ctx, w, state, next)
+	}
+
 	lookupName, err := ls.getLookupName(state.Name())
 	if err != nil {
-		return serveErrorCode(err)
+		return ls.serveError(w, req, err, "")
+	}
+
+	rep, err := ls.lookupOnExternalDNS(ctx, lookupName, state.QName(), state)
+	if err == errRateLimited {
+		return ls.serveRateLimited(w, req, lookupName)
+	}
+	if err != nil {
+		return ls.serveError(w, req, err, lookupName)
+	}
+
+	if ls.filter != nil {
+		// only blocked answers trigger the action, blocked glue is just removed
+		if blocked, _ := ls.filter.apply(rep); blocked > 0 {
+			FilterBlockedCount.WithLabelValues(metrics.WithServer(ctx), ls.filter.action.String()).Add(float64(blocked))
+			log.Infof("Blocked %d address(es) in response for %s (%s)", blocked, state.Name(), lookupName)
+			switch ls.filter.action {
+			case filterNXDomain:
+				rep.Answer = nil
+				rep.Rcode = dns.RcodeNameError
+				ls.attachEDE(rep, errFilteredAnswer, lookupName)
+			case filterRefused:
+				return ls.serveError(w, req, errFilteredAnswer, lookupName)
+			}
+		}
+	}
+
+	ls.setNegativeSOA(rep)
+	w.WriteMsg(rep)
+	return dns.RcodeSuccess, nil
+}
+
+// serveReverse forwards PTR queries as is and rewrites targets of the answer.
+func (ls LocalStar) serveReverse(
+	ctx context.Context,
+	w dns.ResponseWriter,
+	state *request.Request,
+	next func() (int, error),
+) (int, error) {
+	if state.QType() != dns.TypePTR {
+		return next()
 	}
 
-	rep, err := ls.lookupOnExternalDNS(ctx, lookupName, state.Name(), req)
+	rep, err := ls.lookupOnExternalDNS(ctx, state.Name(), state.QName(), state)
+	if err == errRateLimited {
+		return ls.serveRateLimited(w, state.Req, state.Name())
+	}
 	if err != nil {
-		return serveErrorCode(err)
+		return ls.serveError(w, state.Req, err, state.Name())
 	}
+	ls.rewritePTRTargets(rep.Answer)
 
 	w.WriteMsg(rep)
 	return dns.RcodeSuccess, nil
 }
 
+// serveRateLimited responds to a request exceeding rate limits. Truncated
+// replies make clients retry over TCP, so TCP requests are refused instead.
+func (ls LocalStar) serveRateLimited(w dns.ResponseWriter, req *dns.Msg, lookupName string) (int, error) {
+	action := ls.ratelimit.action
+	if action == rateLimitTruncate && (&request.Request{W: w, Req: req}).Proto() == "tcp" {
+		action = rateLimitRefused
+	}
+	switch action {
+	case rateLimitTruncate:
+		rep := new(dns.Msg)
+		rep.SetReply(req)
+		rep.Truncated = true
+		w.WriteMsg(rep)
+		return dns.RcodeSuccess, nil
+	case rateLimitDrop:
+		return dns.RcodeSuccess, nil
+	default:
+		return ls.serveError(w, req, errRateLimited, lookupName)
+	}
+}
+
+// serveError writes a reply with rcode derived from err, clients
+// supporting EDNS get Extended DNS Error as well.
+func (ls LocalStar) serveError(w dns.ResponseWriter, req *dns.Msg, err error, lookupName string) (int, error) {
+	rcode, err := serveErrorCode(err)
+	rep := new(dns.Msg)
+	rep.SetRcode(req, rcode)
+	if clientOpt := req.IsEdns0(); clientOpt != nil {
+		o := newOPT()
+		if clientOpt.Do() {
+			o.SetDo()
+		}
+		rep.Extra = append(rep.Extra, o)
+		ls.attachEDE(rep, err, lookupName)
+	}
+	w.WriteMsg(rep)
+	// the reply is written, so the server must not write another one
+	return dns.RcodeSuccess, err
+}
+
 func serveErrorCode(err error) (int, error) {
 	switch err {
-	case errLoopRequest:
+	case errLoopRequest, errFilteredAnswer, errACLDenied, errRateLimited, errMaxConcurrent:
 		return dns.RcodeRefused, err
+	case errQuestionCount:
+		return dns.RcodeFormatError, err
+	case errNotImplemented:
+		return dns.RcodeNotImplemented, err
 
 	default:
 		return dns.RcodeServerFailure, err
@@ -0,0 +1,331 @@
+package localstar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type HandlerTestSuite struct {
+	suite.Suite
+}
+
+func TestHandlerTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
+
+// newLocalStar returns the plugin serving dev.corp.net with to_zone corp.net,
+// upstream is handled by exchange.
+func (s *HandlerTestSuite) newLocalStar(exchange dnsProviderExchange) LocalStar {
+	return LocalStar{
+		fromZone: "dev.corp.net.",
+		toZone: "corp.net.",
+		toZoneDiff: calcZoneDiff("dev.corp.net.", "corp.net."),
+		prefixLen: 1,
+		edns: newEDNSPolicy(),
+		provider: &stubDNSProvider{exchangeCb: exchange},
+		next: test.NextHandler(dns.RcodeSuccess, nil),
+	}
+}
+
+func (s *HandlerTestSuite) serve(ls LocalStar, req *dns.Msg) (*dnstest.Recorder, int, error) {
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := ls.ServeDNS(context.Background(), rec, req)
+	return rec, rcode, err
+}
+
+func query(name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return req
+}
+
+// answer returns an upstream handler replying with A records.
+func answer(ips ...string) dnsProviderExchange {
+	return func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		res := new(dns.Msg)
+		res.SetReply(msg)
+		for _, ip := range ips {
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A: net.ParseIP(ip),
+			})
+		}
+		return res, nil
+	}
+}
+
+func (s *HandlerTestSuite) Test_answer() {
+	ls := s.newLocalStar(answer("10.1.1.1"))
+	rec, rcode, err := s.serve(ls, query("a.host1.dev.corp.net.", dns.TypeA))
+	s.NoError(err)
+	s.Equal(dns.RcodeSuccess, rcode)
+	if s.NotNil(rec.Msg) && s.Len(rec.Msg.Answer, 1) {
+		s.Equal(dns.RcodeSuccess, rec.Msg.Rcode)
+		s.Equal("a.host1.dev.corp.net.\t60\tIN\tA\t10.1.1.1", rec.Msg.Answer[0].String())
+		s.Empty(rec.Msg.Ns)
+	}
+}
+
+func (s *HandlerTestSuite) Test_answer_large() {
+	txt := strings.Repeat("x", 200)
+	var records []string
+	for i := 0; i < 8; i++ {
+		records = append(records, fmt.Sprintf("host1.corp.net. 60 IN TXT \"%d%s\"", i, txt))
+	}
+	server := startFakeServer(s.T(), records...)
+	provider := new(compositeDNSProvider)
+	s.Require().NoError(provider.Init([]string{server.addr}, time.Second))
+	ls := s.newLocalStar(nil)
+	ls.provider = provider
+
+	// the answer does not fit the buffer advertised upstream, the response
+	// is fetched over TCP
+	for name, w := range map[string]*test.ResponseWriter{
+		"tcp": {TCP: true},
+		"udp": {},
+	} {
+		req := query("host1.dev.corp.net.", dns.TypeTXT)
+		if !w.TCP {
+			req.SetEdns0(4096, false)
+		}
+		rec := dnstest.NewRecorder(w)
+		_, err := ls.ServeDNS(context.Background(), rec, req)
+		s.NoError(err, name)
+		if s.NotNil(rec.Msg, name) {
+			s.Equal(dns.RcodeSuccess, rec.Msg.Rcode, name)
+			s.False(rec.Msg.Truncated, name)
+			s.Len(rec.Msg.Answer, 8, name)
+		}
+	}
+}
+
+func (s *HandlerTestSuite) Test_errors() {
+	upstreamErr := errors.New("upstream error")
+	ls := s.newLocalStar(func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		return nil, upstreamErr
+	})
+
+	for _, tt := range []struct {
+		name  string
+		rcode int
+		err   error
+	}{
+		{"host1.dev.dev.corp.net.", dns.RcodeRefused, errLoopRequest},
+		{"host1.dev.corp.net.", dns.RcodeServerFailure, upstreamErr},
+	}{
+		req := query(tt.name, dns.TypeA)
+		rec, rcode, err := s.serve(ls, req)
+		s.Equal(tt.err, err, tt.name)
+		// the reply is written by the plugin
+		s.Equal(dns.RcodeSuccess, rcode, tt.name)
+		if s.NotNil(rec.Msg, tt.name) {
+			s.Equal(tt.rcode, rec.Msg.Rcode, tt.name)
+			s.Equal(req.Id, rec.Msg.Id, tt.name)
+			s.Equal(req.Question, rec.Msg.Question, tt.name)
+			s.True(rec.Msg.Response, tt.name)
+		}
+	}
+}
+
+func (s *HandlerTestSuite) Test_malformed() {
+	var calls int
+	ls := s.newLocalStar(func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		calls++
+		return answer("10.1.1.1")(ctx, msg)
+	})
+
+	noQuestion := query("host1.dev.corp.net.", dns.TypeA)
+	noQuestion.Question = nil
+	twoQuestions := query("host1.dev.corp.net.", dns.TypeA)
+	twoQuestions.Question = append(twoQuestions.Question, dns.Question{Name: "host2.dev.corp.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	notify := query("dev.corp.net.", dns.TypeSOA)
+	notify.Opcode = dns.OpcodeNotify
+	iquery := query("host1.dev.corp.net.", dns.TypeA)
+	iquery.Opcode = dns.OpcodeIQuery
+	status := query("host1.dev.corp.net.", dns.TypeA)
+	status.Opcode = dns.OpcodeStatus
+	update := new(dns.Msg)
+	update.SetUpdate("dev.corp.net.")
+
+	for name, tt := range map[string]struct {
+		req   *dns.Msg
+		rcode int
+		err   error
+	}{
+		"no question":   {noQuestion, dns.RcodeFormatError, errQuestionCount},
+		"two questions": {twoQuestions, dns.RcodeFormatError, errQuestionCount},
+		"notify":        {notify, dns.RcodeNotImplemented, errNotImplemented},
+		"iquery":        {iquery, dns.RcodeNotImplemented, errNotImplemented},
+		"status":        {status, dns.RcodeNotImplemented, errNotImplemented},
+		"update":        {update, dns.RcodeNotImplemented, errNotImplemented},
+	}{
+		tt.req.SetEdns0(1232, false)
+		rec, rcode, err := s.serve(ls, tt.req)
+		s.Equal(tt.err, err, name)
+		s.Equal(dns.RcodeSuccess, rcode, name)
+		if s.NotNil(rec.Msg, name) {
+			s.Equal(tt.rcode, rec.Msg.Rcode, name)
+			s.Equal(tt.req.Id, rec.Msg.Id, name)
+			s.Equal(tt.req.Opcode, rec.Msg.Opcode, name)
+			s.Empty(rec.Msg.Answer, name)
+			if opt := rec.Msg.IsEdns0(); s.NotNil(opt, name) && s.Len(opt.Option, 1, name) {
+				code, _, ok := parseEDE(opt.Option[0])
+				s.True(ok, name)
+				s.Equal(edeOther, code, name)
+			}
+		}
+	}
+	s.Zero(calls)
+}
+
+func (s *HandlerTestSuite) Test_acl() {
+	ls := s.newLocalStar(answer("10.1.1.1"))
+	ls.acl = &clientACL{rules: []aclRule{{allow: false}}}
+	rec, rcode, err := s.serve(ls, query("host1.dev.corp.net.", dns.TypeA))
+	s.Equal(errACLDenied, err)
+	s.Equal(dns.RcodeSuccess, rcode)
+	if s.NotNil(rec.Msg) {
+		s.Equal(dns.RcodeRefused, rec.Msg.Rcode)
+	}
+
+	ls.acl.drop = true
+	rec, rcode, err = s.serve(ls, query("host1.dev.corp.net.", dns.TypeA))
+	s.NoError(err)
+	s.Equal(dns.RcodeSuccess, rcode)
+	s.Nil(rec.Msg)
+}
+
+func (s *HandlerTestSuite) Test_negative() {
+	// SOA of to_zone is replaced with the serving zone one
+	ls := s.newLocalStar(func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		res := new(dns.Msg)
+		res.SetRcode(msg, dns.RcodeNameError)
+		res.Ns = append(res.Ns, &dns.SOA{
+			Hdr: dns.RR_Header{Name: "corp.net.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns: "ns1.corp.net.", Mbox: "admin.corp.net.", Minttl: 300,
+		})
+		return res, nil
+	})
+	rec, _, err := s.serve(ls, query("host1.dev.corp.net.", dns.TypeA))
+	s.NoError(err)
+	if s.NotNil(rec.Msg) && s.Len(rec.Msg.Ns, 1) {
+		s.Equal(dns.RcodeNameError, rec.Msg.Rcode)
+		soa := rec.Msg.Ns[0].(*dns.SOA)
+		s.Equal("dev.corp.net.", soa.Hdr.Name)
+		s.EqualValues(300, soa.Hdr.Ttl)
+		s.EqualValues(300, soa.Minttl)
+	}
+
+	// NODATA without SOA from upstream
+	ls = s.newLocalStar(answer())
+	rec, _, err = s.serve(ls, query("host1.dev.corp.net.", dns.TypeA))
+	s.NoError(err)
+	if s.NotNil(rec.Msg) && s.Len(rec.Msg.Ns, 1) {
+		s.Equal(dns.RcodeSuccess, rec.Msg.Rcode)
+		s.Equal("dev.corp.net.", rec.Msg.Ns[0].Header().Name)
+		s.EqualValues(negativeTTL, rec.Msg.Ns[0].Header().Ttl)
+	}
+
+	// answer blocked by filter
+	ls = s.newLocalStar(answer("127.0.0.1"))
+	ls.filter = &addrFilter{deny: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}, action: filterNXDomain}
+	rec, _, err = s.serve(ls, query("host1.dev.corp.net.", dns.TypeA))
+	s.NoError(err)
+	if s.NotNil(rec.Msg) {
+		s.Equal(dns.RcodeNameError, rec.Msg.Rcode)
+		s.Empty(rec.Msg.Answer)
+		if s.Len(rec.Msg.Ns, 1) {
+			s.IsType(&dns.SOA{}, rec.Msg.Ns[0])
+		}
+	}
+
+	ls.filter.action = filterRefused
+	rec, _, err = s.serve(ls, query("host1.dev.corp.net.", dns.TypeA))
+	s.Equal(errFilteredAnswer, err)
+	if s.NotNil(rec.Msg) {
+		s.Equal(dns.RcodeRefused, rec.Msg.Rcode)
+		s.Empty(rec.Msg.Answer)
+	}
+}
+
+func (s *HandlerTestSuite) Test_filter_glue() {
+	ls := s.newLocalStar(func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		res := new(dns.Msg)
+		res.SetReply(msg)
+		res.Answer = append(res.Answer, &dns.MX{
+			Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60},
+			Preference: 10, Mx: "mail.corp.net.",
+		})
+		res.Extra = append(res.Extra, &dns.A{
+			Hdr: dns.RR_Header{Name: "mail.corp.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A: net.ParseIP("8.8.8.8"),
+		})
+		return res, nil
+	})
+	allow, _ := parseNets([]string{"private"})
+	// blocked glue is removed, but the answer is served
+	for _, action := range []filterAction{filterNXDomain, filterRefused} {
+		ls.filter = &addrFilter{allow: allow, action: action}
+		rec, _, err := s.serve(ls, query("host1.dev.corp.net.", dns.TypeMX))
+		s.NoError(err)
+		if s.NotNil(rec.Msg) {
+			s.Equal(dns.RcodeSuccess, rec.Msg.Rcode)
+			s.Len(rec.Msg.Answer, 1)
+			s.Empty(rec.Msg.Extra)
+		}
+	}
+}
+
+func (s *HandlerTestSuite) Test_ratelimit() {
+	ls := s.newLocalStar(answer("10.1.1.1"))
+	ls.ratelimit = &rateLimits{target: newLimiterSet(1, 1)}
+	rec, _, err := s.serve(ls, query("host1.dev.corp.net.", dns.TypeA))
+	s.NoError(err)
+	s.NotNil(rec.Msg)
+
+	rec, _, err = s.serve(ls, query("host1.dev.corp.net.", dns.TypeA))
+	s.Equal(errRateLimited, err)
+	if s.NotNil(rec.Msg) {
+		s.Equal(dns.RcodeRefused, rec.Msg.Rcode)
+	}
+
+	ls.ratelimit.action = rateLimitTruncate
+	rec, _, err = s.serve(ls, query("host1.dev.corp.net.", dns.TypeA))
+	s.NoError(err)
+	if s.NotNil(rec.Msg) {
+		s.Equal(dns.RcodeSuccess, rec.Msg.Rcode)
+		s.True(rec.Msg.Truncated)
+	}
+
+	// retries over TCP are not truncated again
+	rec = dnstest.NewRecorder(&test.ResponseWriter{TCP: true})
+	_, err = ls.ServeDNS(context.Background(), rec, query("host1.dev.corp.net.", dns.TypeA))
+	s.Equal(errRateLimited, err)
+	if s.NotNil(rec.Msg) {
+		s.Equal(dns.RcodeRefused, rec.Msg.Rcode)
+		s.False(rec.Msg.Truncated)
+	}
+}
+
+func (s *HandlerTestSuite) Test_next() {
+	ls := s.newLocalStar(func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		s.Fail("provider must not be called")
+		return nil, nil
+	})
+	req := query("host1.dev.corp.net.", dns.TypeA)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	rec, rcode, err := s.serve(ls, req)
+	s.NoError(err)
+	s.Equal(dns.RcodeSuccess, rcode)
+	s.Nil(rec.Msg)
+}
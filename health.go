@@ -0,0 +1,124 @@
+package localstar
+
+// Active health checks of endpoints.
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultMaxFails = 2
+
+// healthCheck defines probing of endpoints, an endpoint is unhealthy after
+// maxFails failed probes in a row and gets healthy after a successful one.
+type healthCheck struct {
+	interval time.Duration // disabled if zero
+	name     string
+	qtype    uint16
+	maxFails int32 // endpoints are never unhealthy if zero
+}
+
+func newHealthCheck() healthCheck {
+	return healthCheck{name: ".", qtype: dns.TypeNS, maxFails: defaultMaxFails}
+}
+
+// healthReporter is implemented by providers checking health of endpoints.
+type healthReporter interface {
+	// healthy reports whether there is a healthy endpoint.
+	healthy() bool
+}
+
+// endpointHealth is health state of an endpoint.
+type endpointHealth struct {
+	fails int32 // failed probes in a row
+}
+
+func (h *endpointHealth) healthy(maxFails int32) bool {
+	return maxFails == 0 || atomic.LoadInt32(&h.fails) < maxFails
+}
+
+// healthyProviders returns providers of healthy endpoints or all of them
+// if there are no healthy ones.
+func (p *compositeDNSProvider) healthyProviders() []endpointProvider {
+	if p.check.interval == 0 {
+		return p.providers
+	}
+	res := make([]endpointProvider, 0, len(p.providers))
+	for i, provider := range p.providers {
+		if p.health[i].healthy(p.check.maxFails) {
+			res = append(res, provider)
+		}
+	}
+	if len(res) == 0 {
+		return p.providers
+	}
+	return res
+}
+
+func (p *compositeDNSProvider) healthy() bool {
+	if p.check.interval == 0 {
+		return true
+	}
+	for _, h := range p.health {
+		if h.healthy(p.check.maxFails) {
+			return true
+		}
+	}
+	return false
+}
+
+// runHealthCheck probes endpoints every interval until done is closed.
+func (p *compositeDNSProvider) runHealthCheck(done <-chan struct{}) {
+	ticker := time.NewTicker(p.check.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			p.probeAll()
+		}
+	}
+}
+
+func (p *compositeDNSProvider) probeAll() {
+	var wg sync.WaitGroup
+	for i := range p.providers {
+		wg.Add(1)
+		go func (i int) {
+			defer wg.Done()
+			p.probe(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// probe sends the probe query to the endpoint and updates its health.
+func (p *compositeDNSProvider) probe(i int) {
+	endpoint, h := p.endpoints[i], p.health[i]
+	msg := new(dns.Msg)
+	msg.SetQuestion(p.check.name, p.check.qtype)
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	res, err := p.providers[i].Exchange(ctx, msg)
+	if err == nil {
+		err = validateResponse(msg, res, p.matchCase)
+	}
+
+	if err == nil {
+		if atomic.SwapInt32(&h.fails, 0) >= p.check.maxFails && p.check.maxFails > 0 {
+			log.Infof("Endpoint %s is healthy again", endpoint)
+		}
+		EndpointHealthyGauge.WithLabelValues(endpoint).Set(1)
+		return
+	}
+	HealthCheckFailureCount.WithLabelValues(endpoint).Inc()
+	if atomic.AddInt32(&h.fails, 1) == p.check.maxFails {
+		log.Warningf("Endpoint %s is unhealthy: %s", endpoint, err)
+		EndpointHealthyGauge.WithLabelValues(endpoint).Set(0)
+	}
+}
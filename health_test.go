@@ -0,0 +1,153 @@
+package localstar
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type HealthTestSuite struct {
+	suite.Suite
+}
+
+func TestHealthTestSuite(t *testing.T) {
+	suite.Run(t, new(HealthTestSuite))
+}
+
+// stubProvider answers queries with rcode after delay or fails them if
+// failing or err is set.
+type stubProvider struct {
+	sync.Mutex
+	failing bool
+	err     error
+	rcode   int
+	delay   time.Duration
+	queries []dns.Question
+}
+
+func (p *stubProvider) count() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.queries)
+}
+
+func (p *stubProvider) Init(endpoints []string, timeout time.Duration) error { return nil }
+
+func (p *stubProvider) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	p.Lock()
+	p.queries = append(p.queries, msg.Question[0])
+	delay := p.delay
+	p.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.failing {
+		return nil, errors.New("query failed")
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	res := new(dns.Msg)
+	res.SetRcode(msg, p.rcode)
+	return res, nil
+}
+
+func (s *HealthTestSuite) newProvider(stubs ...*stubProvider) *compositeDNSProvider {
+	p := &compositeDNSProvider{check: newHealthCheck(), timeout: time.Second}
+	p.check.interval = time.Minute
+	for i, stub := range stubs {
+		p.endpoints = append(p.endpoints, string(rune('a' + i)) + ".test:53")
+		p.providers = append(p.providers, stub)
+		p.health = append(p.health, new(endpointHealth))
+	}
+	return p
+}
+
+func (s *HealthTestSuite) Test_probe() {
+	a, b := new(stubProvider), new(stubProvider)
+	p := s.newProvider(a, b)
+	s.True(p.healthy())
+	s.Equal([]endpointProvider{a, b}, p.healthyProviders())
+
+	a.failing = true
+	p.probeAll()
+	if s.Len(a.queries, 1) {
+		s.Equal(dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET}, a.queries[0])
+	}
+	s.Equal([]endpointProvider{a, b}, p.healthyProviders())
+	p.probeAll()
+	s.Equal([]endpointProvider{b}, p.healthyProviders())
+	s.True(p.healthy())
+
+	// no healthy endpoints, all of them are used
+	b.failing = true
+	p.probeAll()
+	p.probeAll()
+	s.False(p.healthy())
+	s.Equal([]endpointProvider{a, b}, p.healthyProviders())
+
+	a.failing = false
+	p.probeAll()
+	s.True(p.healthy())
+	s.Equal([]endpointProvider{a}, p.healthyProviders())
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	_, err := p.Exchange(context.Background(), msg)
+	s.NoError(err)
+	s.Len(b.queries, 5) // probes only
+}
+
+func (s *HealthTestSuite) Test_disabled() {
+	a := &stubProvider{failing: true}
+	p := s.newProvider(a)
+	p.check.maxFails = 0
+	p.probeAll()
+	p.probeAll()
+	s.True(p.healthy())
+
+	p = s.newProvider(a)
+	p.check.interval = 0
+	p.health[0].fails = 10
+	s.True(p.healthy())
+	s.Equal([]endpointProvider{a}, p.healthyProviders())
+}
+
+func (s *HealthTestSuite) Test_runHealthCheck() {
+	a := &stubProvider{failing: true}
+	p := s.newProvider(a)
+	p.check.interval = 10 * time.Millisecond
+	p.check.name, p.check.qtype = "probe.corp.net.", dns.TypeA
+	s.NoError(p.start())
+	s.Eventually(func () bool { return !p.healthy() }, time.Second, 10 * time.Millisecond)
+	s.NoError(p.stop())
+	s.Nil(p.done)
+	a.Lock()
+	defer a.Unlock()
+	s.Equal("probe.corp.net.", a.queries[0].Name)
+	s.Equal(dns.TypeA, a.queries[0].Qtype)
+}
+
+func (s *HealthTestSuite) Test_Ready() {
+	a := &stubProvider{failing: true}
+	p := s.newProvider(a)
+	ls := LocalStar{provider: p}
+	s.True(ls.Ready())
+	p.probeAll()
+	p.probeAll()
+	s.False(ls.Ready())
+
+	ls.provider = a
+	s.True(ls.Ready())
+}
@@ -0,0 +1,141 @@
+package localstar
+
+// Hedged queries: a query is sent to the next endpoint if the current one
+// is slow, the first valid response wins.
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultHedgeDelay = 100 * time.Millisecond // until enough latencies are observed
+	latencyWindowSize = 256
+	latencyMinSamples = 16
+)
+
+// hedgePolicy defines when queries are hedged, either after a fixed delay
+// or after a percentile of observed latencies.
+type hedgePolicy struct {
+	delay      time.Duration // disabled if zero and no percentile
+	percentile int
+}
+
+func (h hedgePolicy) enabled() bool {
+	return h.delay > 0 || h.percentile > 0
+}
+
+// latencyWindow keeps latencies of last successful exchanges.
+type latencyWindow struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// percentile returns p-th percentile of latencies, false if there are
+// too few of them.
+func (w *latencyWindow) percentile(p int) (time.Duration, bool) {
+	w.Lock()
+	samples := append([]time.Duration{}, w.samples...)
+	w.Unlock()
+	if len(samples) < latencyMinSamples {
+		return 0, false
+	}
+	sort.Slice(samples, func (i, j int) bool { return samples[i] < samples[j] })
+	i := (len(samples) * p + 99) / 100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return samples[i], true
+}
+
+// hedgeDelay returns the time to wait for an endpoint before sending
+// the query to the next one.
+func (p *compositeDNSProvider) hedgeDelay() time.Duration {
+	if p.hedge.percentile > 0 {
+		if d, ok := p.latencies.percentile(p.hedge.percentile); ok {
+			return d
+		}
+		if p.hedge.delay == 0 {
+			return defaultHedgeDelay
+		}
+	}
+	return p.hedge.delay
+}
+
+type hedgeResult struct {
+	res     *dns.Msg
+	err     error
+	elapsed time.Duration
+}
+
+// exchangeHedged starts with the first provider and sends the query to the
+// next one whenever the delay passes or an exchange fails, other exchanges
+// are cancelled once a valid response is received.
+func (p *compositeDNSProvider) exchangeHedged(ctx context.Context, providers []endpointProvider, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgeResult, len(providers))
+	launch := func (provider endpointProvider) {
+		// every exchange gets its own copy, providers may modify it
+		msg := msg.Copy()
+		go func () {
+			start := time.Now()
+			res, err := p.exchangeEndpoint(ctx, provider, msg)
+			if err == nil {
+				err = validateResponse(msg, res, p.matchCase)
+			}
+			results <- hedgeResult{res, err, time.Since(start)}
+		}()
+	}
+
+	delay := p.hedgeDelay()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	launch(providers[0])
+	next, pending := 1, 1
+	var err error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if p.latencies != nil {
+					p.latencies.add(r.elapsed)
+				}
+				return r.res, nil
+			}
+			err = r.err
+			if next < len(providers) && ctx.Err() == nil && err != errMaxConcurrent {
+				launch(providers[next])
+				next, pending = next + 1, pending + 1
+			}
+		case <-timer.C:
+			if next < len(providers) {
+				HedgedRequestCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+				launch(providers[next])
+				next, pending = next + 1, pending + 1
+				timer.Reset(delay)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
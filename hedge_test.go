@@ -0,0 +1,98 @@
+package localstar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type HedgeTestSuite struct {
+	suite.Suite
+}
+
+func TestHedgeTestSuite(t *testing.T) {
+	suite.Run(t, new(HedgeTestSuite))
+}
+
+func (s *HedgeTestSuite) exchange(p *compositeDNSProvider) (*dns.Msg, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	start := time.Now()
+	res, err := p.Exchange(context.Background(), msg)
+	return res, time.Since(start), err
+}
+
+func (s *HedgeTestSuite) Test_latencyWindow() {
+	w := new(latencyWindow)
+	for i := 1; i < latencyMinSamples; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	_, ok := w.percentile(50)
+	s.False(ok)
+	for i := latencyMinSamples; i <= 100; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	for p, expected := range map[int]time.Duration{
+		1: 1 * time.Millisecond, 50: 50 * time.Millisecond, 95: 95 * time.Millisecond, 100: 100 * time.Millisecond,
+	}{
+		d, ok := w.percentile(p)
+		s.True(ok)
+		s.Equal(expected, d, p)
+	}
+	for i := 0; i < latencyWindowSize; i++ {
+		w.add(time.Second)
+	}
+	d, _ := w.percentile(1)
+	s.Equal(time.Second, d)
+}
+
+func (s *HedgeTestSuite) Test_hedgeDelay() {
+	p := &compositeDNSProvider{hedge: hedgePolicy{delay: 20 * time.Millisecond}}
+	s.Equal(20 * time.Millisecond, p.hedgeDelay())
+
+	p = &compositeDNSProvider{hedge: hedgePolicy{percentile: 90}}
+	s.NoError(p.Init(nil, time.Second))
+	s.Equal(defaultHedgeDelay, p.hedgeDelay())
+	p.hedge.delay = 20 * time.Millisecond
+	s.Equal(20 * time.Millisecond, p.hedgeDelay())
+	for i := 1; i <= 100; i++ {
+		p.latencies.add(time.Duration(i) * time.Millisecond)
+	}
+	s.Equal(90 * time.Millisecond, p.hedgeDelay())
+}
+
+func (s *HedgeTestSuite) Test_exchange() {
+	slow, fast := &stubProvider{delay: time.Second}, new(stubProvider)
+	p := &compositeDNSProvider{hedge: hedgePolicy{delay: 20 * time.Millisecond}}
+	p.providers = []endpointProvider{slow, fast}
+	res, elapsed, err := s.exchange(p)
+	s.NoError(err)
+	s.NotNil(res)
+	s.GreaterOrEqual(int64(elapsed), int64(20 * time.Millisecond))
+	s.Less(int64(elapsed), int64(500 * time.Millisecond))
+	s.Equal(1, slow.count())
+	s.Equal(1, fast.count())
+
+	// the first endpoint answers in time, no hedging
+	first, second := &stubProvider{delay: 5 * time.Millisecond}, new(stubProvider)
+	p.providers = []endpointProvider{first, second}
+	_, _, err = s.exchange(p)
+	s.NoError(err)
+	s.Equal(1, first.count())
+	s.Equal(0, second.count())
+
+	// failures go to the next endpoint without waiting
+	failing := &stubProvider{failing: true}
+	p.hedge.delay = time.Second
+	p.providers = []endpointProvider{failing, fast}
+	_, elapsed, err = s.exchange(p)
+	s.NoError(err)
+	s.Less(int64(elapsed), int64(500 * time.Millisecond))
+
+	p.providers = []endpointProvider{failing, failing}
+	_, _, err = s.exchange(p)
+	s.EqualError(err, "query failed")
+}
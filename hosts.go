@@ -0,0 +1,190 @@
+package localstar
+
+// Static sources of addresses consulted before the upstream DNS.
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	hostsTTL = 3600
+	fileReloadInterval = 5 * time.Second
+)
+
+// hostSource resolves lookup names to addresses without an upstream exchange.
+type hostSource interface {
+	lookup(name string) ([]net.IP, bool)
+}
+
+// runnable is implemented by sources which need a background job.
+type runnable interface {
+	start() error
+	stop() error
+}
+
+// hostsMap maps lookup names to their addresses.
+type hostsMap map[string][]net.IP
+
+func (m hostsMap) add(ip net.IP, names ...string) {
+	for _, name := range names {
+		name = dns.CanonicalName(name)
+		m[name] = append(m[name], ip)
+	}
+}
+
+func (m hostsMap) lookup(name string) ([]net.IP, bool) {
+	ips, ok := m[strings.ToLower(name)]
+	return ips, ok
+}
+
+// parseHostsLine parses a single line in the hosts(5) format, comments
+// and lines with a bad address are ignored.
+func parseHostsLine(line string) (net.IP, []string) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, nil
+	}
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		return nil, nil
+	}
+	return ip, fields[1:]
+}
+
+func parseHostsFile(r io.Reader) (hostsMap, error) {
+	hosts := hostsMap{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if ip, names := parseHostsLine(scanner.Text()); ip != nil {
+			hosts.add(ip, names...)
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// watchedFile is a hostSource backed by a file, which is parsed again
+// every time its modification time or size changes.
+type watchedFile struct {
+	path  string
+	parse func(io.Reader) (hostsMap, error)
+
+	mu    sync.RWMutex
+	hosts hostsMap
+	mtime time.Time
+	size  int64
+
+	stopCh chan struct{}
+}
+
+func newWatchedFile(path string, parse func(io.Reader) (hostsMap, error)) (*watchedFile, error) {
+	f := &watchedFile{path: path, parse: parse}
+	return f, f.readIfChanged()
+}
+
+func (f *watchedFile) lookup(name string) ([]net.IP, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.hosts.lookup(name)
+}
+
+func (f *watchedFile) readIfChanged() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	f.mu.RLock()
+	changed := !stat.ModTime().Equal(f.mtime) || stat.Size() != f.size
+	f.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	hosts, err := f.parse(file)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.hosts = hosts
+	f.mtime = stat.ModTime()
+	f.size = stat.Size()
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *watchedFile) start() error {
+	f.stopCh = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(fileReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-f.stopCh:
+				return
+			case <-ticker.C:
+				if err := f.readIfChanged(); err != nil {
+					log.Warningf("Cannot reload %s: %s", f.path, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (f *watchedFile) stop() error {
+	if f.stopCh != nil {
+		close(f.stopCh)
+		f.stopCh = nil
+	}
+	return nil
+}
+
+// lookupHosts answers msg from host sources, returns nil if no source
+// knows the name.
+func (ls LocalStar) lookupHosts(msg *dns.Msg) *dns.Msg {
+	if len(msg.Question) == 0 {
+		return nil
+	}
+	q := msg.Question[0]
+	for _, src := range ls.sources {
+		ips, ok := src.lookup(q.Name)
+		if !ok {
+			continue
+		}
+		res := new(dns.Msg)
+		res.SetReply(msg)
+		res.Answer = hostsAnswer(q, ips)
+		return res
+	}
+	return nil
+}
+
+func hostsAnswer(q dns.Question, ips []net.IP) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: hostsTTL}
+		switch ip4 := ip.To4(); {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs
+}
@@ -0,0 +1,118 @@
+package localstar
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type HostsTestSuite struct {
+	suite.Suite
+}
+
+func TestHostsTestSuite(t *testing.T) {
+	suite.Run(t, new(HostsTestSuite))
+}
+
+func (s *HostsTestSuite) Test_parseHostsLine() {
+	ip, names := parseHostsLine("10.1.1.1 host1.corp.net host1-alias.corp.net # comment")
+	s.Equal("10.1.1.1", ip.String())
+	s.Equal([]string{"host1.corp.net", "host1-alias.corp.net"}, names)
+
+	ip, names = parseHostsLine("  fd00::1\thost1.corp.net")
+	s.Equal("fd00::1", ip.String())
+	s.Equal([]string{"host1.corp.net"}, names)
+
+	for _, line := range []string{"", "# 10.1.1.1 host1", "10.1.1.1", "host1 10.1.1.1", "10.1.1 host1"} {
+		ip, names = parseHostsLine(line)
+		s.Nil(ip, line)
+		s.Nil(names, line)
+	}
+}
+
+func (s *HostsTestSuite) Test_parseHostsFile() {
+	hosts, err := parseHostsFile(strings.NewReader(`
+		# comment
+		10.1.1.1 host1.corp.net
+		10.1.1.2 Host2.Corp.Net.
+		fd00::1  host1.corp.net
+		bad line
+	`))
+	if s.NoError(err) {
+		ips, ok := hosts.lookup("host1.corp.net.")
+		s.True(ok)
+		s.Equal([]net.IP{net.ParseIP("10.1.1.1"), net.ParseIP("fd00::1")}, ips)
+		ips, ok = hosts.lookup("HOST2.corp.net.")
+		s.True(ok)
+		s.Equal([]net.IP{net.ParseIP("10.1.1.2")}, ips)
+		_, ok = hosts.lookup("host3.corp.net.")
+		s.False(ok)
+	}
+}
+
+func (s *HostsTestSuite) Test_watchedFile() {
+	tmpfile, err := ioutil.TempFile("", "hosts.*")
+	s.Require().NoError(err)
+	defer os.Remove(tmpfile.Name())
+	s.Require().NoError(ioutil.WriteFile(tmpfile.Name(), []byte("10.1.1.1 host1.corp.net\n"), 0644))
+
+	f, err := newWatchedFile(tmpfile.Name(), parseHostsFile)
+	s.Require().NoError(err)
+	ips, ok := f.lookup("host1.corp.net.")
+	s.True(ok)
+	s.Equal([]net.IP{net.ParseIP("10.1.1.1")}, ips)
+
+	// unchanged file is not parsed again
+	f.hosts = hostsMap{}
+	s.NoError(f.readIfChanged())
+	_, ok = f.lookup("host1.corp.net.")
+	s.False(ok)
+
+	s.Require().NoError(ioutil.WriteFile(tmpfile.Name(), []byte("10.1.1.2 host2.corp.net\n"), 0644))
+	s.Require().NoError(os.Chtimes(tmpfile.Name(), time.Now(), time.Now().Add(time.Minute)))
+	s.NoError(f.readIfChanged())
+	_, ok = f.lookup("host1.corp.net.")
+	s.False(ok)
+	ips, ok = f.lookup("host2.corp.net.")
+	s.True(ok)
+	s.Equal([]net.IP{net.ParseIP("10.1.1.2")}, ips)
+
+	_, err = newWatchedFile(tmpfile.Name()+".missing", parseHostsFile)
+	s.Error(err)
+}
+
+func (s *HostsTestSuite) Test_lookupHosts() {
+	hosts := hostsMap{}
+	hosts.add(net.ParseIP("10.1.1.1"), "host1.corp.net")
+	hosts.add(net.ParseIP("fd00::1"), "host1.corp.net")
+	ls := LocalStar{sources: []hostSource{hostsMap{}, hosts}}
+
+	lookup := func (name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		return ls.lookupHosts(msg)
+	}
+
+	res := lookup("host1.corp.net.", dns.TypeA)
+	if s.NotNil(res) && s.Len(res.Answer, 1) {
+		s.True(res.Response)
+		s.Equal(dns.RcodeSuccess, res.Rcode)
+		s.Equal("host1.corp.net.\t3600\tIN\tA\t10.1.1.1", res.Answer[0].String())
+	}
+	res = lookup("host1.corp.net.", dns.TypeAAAA)
+	if s.NotNil(res) && s.Len(res.Answer, 1) {
+		s.Equal("host1.corp.net.\t3600\tIN\tAAAA\tfd00::1", res.Answer[0].String())
+	}
+	res = lookup("host1.corp.net.", dns.TypeMX)
+	if s.NotNil(res) {
+		s.Equal(dns.RcodeSuccess, res.Rcode)
+		s.Empty(res.Answer)
+	}
+	s.Nil(lookup("host2.corp.net.", dns.TypeA))
+}
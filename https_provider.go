@@ -0,0 +1,58 @@
+package localstar
+
+// Upstream provider speaking DNS over HTTPS (RFC 8484).
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/miekg/dns"
+)
+
+// httpsDNSProvider sends queries to an https endpoint with POST requests
+// to the default path, connections are kept alive between queries.
+type httpsDNSProvider struct {
+	addr      string
+	tlsConfig *tls.Config // system roots if nil
+	client    *http.Client
+}
+
+func newHTTPSDNSProvider(addr string, timeout time.Duration, tlsConfig *tls.Config) *httpsDNSProvider {
+	p := &httpsDNSProvider{addr: addr, tlsConfig: tlsConfig}
+	if tlsConfig == nil {
+		tlsConfig = new(tls.Config)
+	}
+	p.client = &http.Client{Transport: pkgtls.NewHTTPSTransport(tlsConfig.Clone()), Timeout: timeout}
+	return p
+}
+
+// Exchange sends msg to the endpoint.
+func (p *httpsDNSProvider) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	req, err := doh.NewRequest(http.MethodPost, p.addr, msg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: HTTP status %d", errInvalidResponse, resp.StatusCode)
+	}
+	return doh.ResponseToMsg(resp)
+}
+
+// start implements runnable.
+func (p *httpsDNSProvider) start() error { return nil }
+
+// stop implements runnable and closes idle connections.
+func (p *httpsDNSProvider) stop() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
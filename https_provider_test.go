@@ -0,0 +1,100 @@
+package localstar
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type HTTPSDNSProviderTestSuite struct {
+	suite.Suite
+}
+
+func TestHTTPSDNSProviderTestSuite(t *testing.T) {
+	suite.Run(t, new(HTTPSDNSProviderTestSuite))
+}
+
+// startServer starts DoH server, it returns its address and TLS config
+// trusting its certificate.
+func (s *HTTPSDNSProviderTestSuite) startServer(handler dns.HandlerFunc) (string, *tls.Config, func()) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != doh.Path {
+			http.NotFound(w, r)
+			return
+		}
+		req, err := doh.RequestToMsg(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec := &dohResponseWriter{}
+		handler(rec, req)
+		if rec.msg == nil {
+			http.Error(w, "no response", http.StatusInternalServerError)
+			return
+		}
+		buf, _ := rec.msg.Pack()
+		w.Header().Set("Content-Type", doh.MimeType)
+		w.Write(buf)
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return server.Listener.Addr().String(), &tls.Config{RootCAs: pool}, server.Close
+}
+
+type dohResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (s *HTTPSDNSProviderTestSuite) Test_exchange() {
+	addr, tlsConfig, stop := s.startServer(func (w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Name == "fail.corp.net." {
+			return
+		}
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A: net.ParseIP("10.1.1.1"),
+		})
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	p := newHTTPSDNSProvider(addr, time.Second, tlsConfig)
+	defer p.stop()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	res, err := p.Exchange(context.Background(), msg)
+	if s.NoError(err) && s.NotNil(res) && s.Len(res.Answer, 1) {
+		s.Equal("10.1.1.1", res.Answer[0].(*dns.A).A.String())
+	}
+
+	msg.SetQuestion("fail.corp.net.", dns.TypeA)
+	res, err = p.Exchange(context.Background(), msg)
+	s.Nil(res)
+	s.ErrorIs(err, errInvalidResponse)
+
+	// the certificate is not trusted by default
+	p = newHTTPSDNSProvider(addr, time.Second, nil)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	res, err = p.Exchange(context.Background(), msg)
+	s.Nil(res)
+	s.Error(err)
+}
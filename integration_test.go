@@ -0,0 +1,202 @@
+package localstar
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	coretest "github.com/coredns/coredns/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type IntegrationTestSuite struct {
+	suite.Suite
+	instance *caddy.Instance
+	addr     string // of both server blocks
+}
+
+func TestIntegrationTestSuite(t *testing.T) {
+	suite.Run(t, new(IntegrationTestSuite))
+}
+
+const integrationZone = `$ORIGIN corp.net.
+@      3600 IN SOA ns.corp.net. admin.corp.net. 1 7200 3600 1209600 300
+@      3600 IN NS  ns
+ns     3600 IN A   10.0.0.53
+host1  3600 IN A   10.1.1.1
+host1  3600 IN TXT "host1"
+`
+
+var registerDirective sync.Once
+
+// SetupSuite starts CoreDNS with corp.net served by the file plugin and
+// dev.corp.net translated to it by localstar on the same port, broken.net
+// is translated to an endpoint that never answers.
+func (s *IntegrationTestSuite) SetupSuite() {
+	// insert localstar before whoami like cmd/coredns.go does
+	registerDirective.Do(func () {
+		for i, d := range dnsserver.Directives {
+			if d == "whoami" {
+				dnsserver.Directives = append(dnsserver.Directives[:i], append([]string{name}, dnsserver.Directives[i:]...)...)
+				return
+			}
+		}
+	})
+
+	zoneFile, err := ioutil.TempFile("", "corp.net.*.zone")
+	s.Require().NoError(err)
+	_, err = zoneFile.WriteString(integrationZone)
+	s.Require().NoError(err)
+	s.Require().NoError(zoneFile.Close())
+	s.T().Cleanup(func () { os.Remove(zoneFile.Name()) })
+
+	dropping := startFakeServer(s.T())
+	dropping.setFaults(fakeFaults{drop: true})
+
+	port := s.freePort()
+	s.addr = net.JoinHostPort("127.0.0.1", port)
+	corefile := fmt.Sprintf(`corp.net:%[1]s {
+		bind 127.0.0.1
+		file %[2]s
+	}
+	dev.corp.net:%[1]s {
+		bind 127.0.0.1
+		localstar {
+			to_zone corp.net
+			endpoint %[3]s
+			timeout 1s
+		}
+		chaos # allows CH class queries
+		whoami
+	}
+	broken.net:%[1]s {
+		bind 127.0.0.1
+		localstar {
+			to_zone corp.net
+			endpoint %[4]s
+			timeout 100ms
+		}
+	}`, port, zoneFile.Name(), s.addr, dropping.addr)
+	s.instance, err = coretest.CoreDNSServer(corefile)
+	s.Require().NoError(err)
+}
+
+func (s *IntegrationTestSuite) TearDownSuite() {
+	if s.instance != nil {
+		coretest.CoreDNSServerStop(s.instance)
+	}
+}
+
+// freePort returns a port free for both UDP and TCP.
+func (s *IntegrationTestSuite) freePort() string {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		s.Require().NoError(err)
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		pc, err := net.ListenPacket("udp", l.Addr().String())
+		l.Close()
+		if err == nil {
+			pc.Close()
+			return port
+		}
+	}
+	s.FailNow("no free port")
+	return ""
+}
+
+// exchange sends the query over UDP and TCP and checks both responses are the same.
+func (s *IntegrationTestSuite) exchange(name string, qtype uint16, modify ...func (*dns.Msg)) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	for _, m := range modify {
+		m(req)
+	}
+	var res *dns.Msg
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: network, Timeout: 2 * time.Second}
+		r, _, err := client.Exchange(req, s.addr)
+		s.Require().NoError(err, network)
+		if res != nil {
+			s.Equal(res.Rcode, r.Rcode, network)
+			s.Equal(len(res.Answer), len(r.Answer), network)
+		}
+		res = r
+	}
+	return res
+}
+
+func (s *IntegrationTestSuite) Test_translation() {
+	for _, name := range []string{"host1.dev.corp.net.", "Host1.Dev.Corp.Net.", "www.host1.dev.corp.net."} {
+		res := s.exchange(name, dns.TypeA)
+		s.Equal(dns.RcodeSuccess, res.Rcode, name)
+		if s.Len(res.Answer, 1, name) {
+			s.Equal(name, res.Answer[0].Header().Name)
+			s.Equal("10.1.1.1", res.Answer[0].(*dns.A).A.String())
+		}
+		s.Equal(name, res.Question[0].Name)
+	}
+
+	res := s.exchange("host1.dev.corp.net.", dns.TypeTXT)
+	if s.Len(res.Answer, 1) {
+		s.Equal([]string{"host1"}, res.Answer[0].(*dns.TXT).Txt)
+	}
+
+	// no data
+	res = s.exchange("host1.dev.corp.net.", dns.TypeAAAA)
+	s.Equal(dns.RcodeSuccess, res.Rcode)
+	s.Empty(res.Answer)
+	if s.Len(res.Ns, 1) {
+		s.Equal("dev.corp.net.", res.Ns[0].Header().Name)
+	}
+
+	res = s.exchange("host2.dev.corp.net.", dns.TypeA)
+	s.Equal(dns.RcodeNameError, res.Rcode)
+	if s.Len(res.Ns, 1) && s.IsType(&dns.SOA{}, res.Ns[0]) {
+		s.Equal("dev.corp.net.", res.Ns[0].Header().Name)
+		s.LessOrEqual(res.Ns[0].Header().Ttl, uint32(300))
+	}
+}
+
+func (s *IntegrationTestSuite) Test_loop() {
+	res := s.exchange("host1.dev.dev.corp.net.", dns.TypeA, func (m *dns.Msg) { m.SetEdns0(1232, false) })
+	s.Equal(dns.RcodeRefused, res.Rcode)
+	s.Empty(res.Answer)
+	if opt := res.IsEdns0(); s.NotNil(opt) && s.Len(opt.Option, 1) {
+		code, _, ok := parseEDE(opt.Option[0])
+		s.True(ok)
+		s.Equal(edeProhibited, code)
+	}
+}
+
+func (s *IntegrationTestSuite) Test_fallthrough() {
+	// other classes are passed to the next plugin
+	res := s.exchange("host1.dev.corp.net.", dns.TypeA, func (m *dns.Msg) { m.Question[0].Qclass = dns.ClassCHAOS })
+	s.Equal(dns.RcodeSuccess, res.Rcode)
+	var whoami bool
+	for _, rr := range res.Extra {
+		if _, ok := rr.(*dns.SRV); ok && strings.HasPrefix(rr.Header().Name, "_") {
+			whoami = true
+		}
+	}
+	s.True(whoami, "response must be written by whoami")
+}
+
+func (s *IntegrationTestSuite) Test_errors() {
+	start := time.Now()
+	res := s.exchange("host1.broken.net.", dns.TypeA, func (m *dns.Msg) { m.SetEdns0(1232, false) })
+	s.Less(int64(time.Since(start)), int64(time.Second))
+	s.Equal(dns.RcodeServerFailure, res.Rcode)
+	if opt := res.IsEdns0(); s.NotNil(opt) && s.Len(opt.Option, 1) {
+		code, _, ok := parseEDE(opt.Option[0])
+		s.True(ok)
+		s.Contains([]uint16{edeNoReachableAuthority, edeNetworkError}, code)
+	}
+}
@@ -2,24 +2,34 @@ package localstar
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"errors"
+	"net"
 	"strings"
 	"time"
 
-	// clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/coredns/coredns/plugin/metrics"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
 
 const (
 	name = "localstar"
 	defaultTimeout = 5 * time.Second
+	negativeTTL = 60 // when upstream doesn't provide SOA
 )
-// var log = clog.NewWithPlugin(name)
+var log = clog.NewWithPlugin(name)
 
 var (
 	errLoopRequest = errors.New("loop request")
+	errNotInZone = errors.New("name is not in zone")
+	errQuestionCount = errors.New("query must have exactly one question")
+	errNotImplemented = errors.New("opcode is not implemented")
 )
 
 // LocalStar is a plugin that forward requests to other zone.
@@ -31,6 +41,22 @@ type LocalStar struct {
 	prefixLen int // in labels
 	timeout time.Duration
 	defaultEndpoints []string
+	reverse bool // serving zone is in-addr.arpa or ip6.arpa
+	ptrZone string // zone PTR targets under to_zone are rewritten to
+	sources []hostSource
+	updates *updateStore
+	filter *addrFilter
+	acl *clientACL
+	ratelimit *rateLimits
+	concurrency *concurrencyLimit
+	randomizeCase bool // DNS 0x20 for upstream queries
+	tsig *tsigKey // signs upstream queries
+	edns ednsPolicy
+	edeExtraText bool // add lookup name to Extended DNS Errors
+	tlsConfig *tls.Config // for connections to endpoints
+	healthCheck healthCheck
+	hedge hedgePolicy
+	retry retryPolicy
 	provider dnsProvider
 	next plugin.Handler
 }
@@ -42,6 +68,10 @@ func newLocalStar(config *dnsserver.Config) LocalStar {
 		prefixLen: 1,
 		timeout: defaultTimeout,
 		defaultEndpoints: []string{"/etc/resolv.conf"},
+		reverse: dnsutil.IsReverse(config.Zone) > 0,
+		edns: newEDNSPolicy(),
+		healthCheck: newHealthCheck(),
+		retry: retryPolicy{attempts: 1},
 	}
 }
 
@@ -52,8 +82,16 @@ func calcZoneDiff(from, to string) string {
 	return ""
 }
 
+// getLookupName translates qname in fromZone to a name in toZone, the zone
+// apex is translated to the apex.
 func (ls LocalStar) getLookupName(qname string) (string, error) {
+	if len(qname) < len(ls.fromZone) || !strings.EqualFold(qname[len(qname)-len(ls.fromZone):], ls.fromZone) {
+		return "", errNotInZone
+	}
 	prefix := qname[:len(qname)-len(ls.fromZone)]
+	if prefix != "" && ls.fromZone != "." && !strings.HasSuffix(prefix, ".") {
+		return "", errNotInZone
+	}
 	if ls.toZoneDiff != "" && strings.HasSuffix(prefix, ls.toZoneDiff) {
 		return "", errLoopRequest
 	}
@@ -62,42 +100,156 @@ func (ls LocalStar) getLookupName(qname string) (string, error) {
 	if cnt > len(parts) {
 		cnt = len(parts)
 	}
-	prefix = strings.Join(parts[len(parts)-cnt:], ".")
-	return prefix + "." + ls.toZone, nil
+	if cnt <= 0 {
+		return ls.toZone, nil
+	}
+	return dnsutil.Join(append(parts[len(parts)-cnt:], ls.toZone)...), nil
+}
+
+// getForwardZone returns the first non-reverse zone among server block keys.
+func getForwardZone(keys []string) string {
+	for _, key := range keys {
+		zone := plugin.Host(key).Normalize()
+		if zone != "" && dnsutil.IsReverse(zone) == 0 {
+			return zone
+		}
+	}
+	return ""
+}
+
+// rewritePTRTargets replaces PTR targets under to_zone with their
+// equivalents in the forward zone.
+func (ls LocalStar) rewritePTRTargets(rrs []dns.RR) {
+	for _, rr := range rrs {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok {
+			continue
+		}
+		target := strings.ToLower(dns.Fqdn(ptr.Ptr))
+		if target == ls.toZone || !dns.IsSubDomain(ls.toZone, target) {
+			continue
+		}
+		// already points to the forward zone (it may be a child of to_zone)
+		if dns.IsSubDomain(ls.ptrZone, target) {
+			continue
+		}
+		ptr.Ptr = target[:len(target)-len(ls.toZone)] + ls.ptrZone
+	}
 }
 
 func copyMsgWithQName(src *dns.Msg, name string) *dns.Msg {
 	dst := src.Copy()
-	dst.Question[0].Name = dns.Fqdn(name)
+	if len(dst.Question) > 0 {
+		dst.Question[0].Name = dns.Fqdn(name)
+	}
 	return dst
 }
 
 func replaceRRName(rrs []dns.RR, from, to string) {
 	for _, rr := range rrs {
-		if rr.Header().Name == from {
+		if strings.EqualFold(rr.Header().Name, from) {
 			rr.Header().Name = to
 		}
 	}
 }
 
+// soa returns SOA record of the serving zone.
+func (ls LocalStar) soa(ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{Name: ls.fromZone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns: "ns.dns." + ls.fromZone,
+		Mbox: "hostmaster." + ls.fromZone,
+		Serial: uint32(time.Now().Unix()),
+		Refresh: 7200,
+		Retry: 1800,
+		Expire: 86400,
+		Minttl: ttl,
+	}
+}
+
+// setNegativeSOA puts SOA of the serving zone to negative answers, SOA of
+// to_zone returned by upstream is out of the zone clients asked for.
+func (ls LocalStar) setNegativeSOA(rep *dns.Msg) {
+	if rep.Rcode != dns.RcodeNameError && (rep.Rcode != dns.RcodeSuccess || len(rep.Answer) > 0) {
+		return
+	}
+	ttl := uint32(negativeTTL)
+	var ns []dns.RR
+	for _, rr := range rep.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			ns = append(ns, rr)
+			continue
+		}
+		// negative TTL as defined by RFC 2308
+		ttl = soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	}
+	rep.Ns = append(ns, ls.soa(ttl))
+}
+
+// randomizeCase randomly changes case of letters in name (DNS 0x20).
+func randomizeCase(name string) string {
+	bits := make([]byte, len(name))
+	if _, err := rand.Read(bits); err != nil {
+		return name
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if bits[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
 func (ls LocalStar) lookupOnExternalDNS(
 	ctx context.Context,
 	lookupName string,
 	origName string,
-	req *dns.Msg,
+	state *request.Request,
 ) (*dns.Msg, error) {
-	msg := copyMsgWithQName(req, lookupName)
-	res, err := ls.provider.Exchange(ctx, msg)
-	if err != nil {
-		return nil, err
+	req := state.Req
+	qname := lookupName
+	if ls.randomizeCase {
+		qname = randomizeCase(lookupName)
+	}
+	msg := copyMsgWithQName(req, qname)
+	ls.edns.prepareRequest(msg, net.ParseIP(state.IP()))
+	res := ls.lookupHosts(msg)
+	if res == nil {
+		if ls.ratelimit != nil {
+			if limit := ls.ratelimit.allow(state.IP(), lookupName); limit != "" {
+				RateLimitedCount.WithLabelValues(metrics.WithServer(ctx), limit).Inc()
+				return nil, errRateLimited
+			}
+		}
+		var err error
+		res, err = ls.provider.Exchange(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	rcode := res.Rcode
 	res.SetReply(req)
+	res.Rcode = rcode // SetReply resets it
 	res.Authoritative = false
+	ls.edns.prepareReply(req, res)
 	// r.RecursionAvailable = true
 	// Replace back to original name
 	replaceRRName(res.Answer, lookupName, origName)
 	replaceRRName(res.Ns    , lookupName, origName)
 	replaceRRName(res.Extra , lookupName, origName)
+	// upstream buffer size may be bigger than the client's one
+	res.Truncate(state.Size())
 	return res, nil
 }
@@ -3,9 +3,12 @@ package localstar
 import (
 	"context"
 	"errors"
+	"net"
+	"strings"
 	"testing"
 
 	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/test"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/suite"
@@ -62,6 +65,14 @@ func (s *LocalStarTestSuite) Test_getLookupName() {
 		{"dev.corp.net", "my.com", 2, "d.c.b.a.dev.corp.net", "b.a.my.com", nil},
 		{"dev.corp.net", "my.com", 3, "d.c.b.a.dev.corp.net", "c.b.a.my.com", nil},
 		{"dev.corp.net", "my.com", 4, "d.c.b.a.dev.corp.net", "d.c.b.a.my.com", nil},
+		{"dev.corp.net", "corp.net", 1, "Host.Dev.Corp.Net", "Host.corp.net", nil},
+		{"dev.corp.net", "corp.net", 1, "dev.corp.net", "corp.net", nil},
+		{"dev.corp.net", "corp.net", 1, "xdev.corp.net", "", errNotInZone},
+		{"dev.corp.net", "corp.net", 1, "corp.net", "", errNotInZone},
+		{"dev.corp.net", "corp.net", 1, ".", "", errNotInZone},
+		{".", "corp.net", 1, "host.dev.net", "net.corp.net", nil},
+		{".", "corp.net", 1, ".", "corp.net", nil},
+		{"dev.corp.net", ".", 1, "host.dev.corp.net", "host", nil},
 	}
 	for _, t := range tests {
 		t.from = dns.Fqdn(t.from)
@@ -88,7 +99,7 @@ func (s *LocalStarTestSuite) Test_lookupOnExternalDNS() {
 		msg := new(dns.Msg)
 		msg.SetQuestion(origName, dns.TypeA)
 		msg.Id = 1
-		return ls.lookupOnExternalDNS(ctx0, lookupName, origName, msg)
+		return ls.lookupOnExternalDNS(ctx0, lookupName, origName, &request.Request{W: &test.ResponseWriter{}, Req: msg})
 	}
 	msgQname := func (msg *dns.Msg) string {
 		return (&request.Request{Req: msg}).Name()
@@ -146,3 +157,127 @@ func (s *LocalStarTestSuite) Test_lookupOnExternalDNS() {
 		}
 	}
 }
+
+func (s *LocalStarTestSuite) Test_getForwardZone() {
+	s.Equal("", getForwardZone(nil))
+	s.Equal("", getForwardZone([]string{"10.in-addr.arpa"}))
+	s.Equal("", getForwardZone([]string{"10.0.0.0/8"}))
+	s.Equal("dev.corp.net.", getForwardZone([]string{"10.in-addr.arpa", "dev.corp.net"}))
+	s.Equal("dev.corp.net.", getForwardZone([]string{"dns://Dev.Corp.Net:1053", "other.net"}))
+}
+
+func (s *LocalStarTestSuite) Test_rewritePTRTargets() {
+	ls := LocalStar{toZone: "corp.net.", ptrZone: "dev.corp.net."}
+	ptr := func (target string) dns.RR {
+		return &dns.PTR{Hdr: dns.RR_Header{Name: "1.0.0.10.in-addr.arpa.", Rrtype: dns.TypePTR}, Ptr: target}
+	}
+	rrs := []dns.RR{
+		ptr("host1.corp.net."),
+		ptr("Host2.Corp.Net."),
+		ptr("a.b.corp.net."),
+		ptr("corp.net."),
+		ptr("host1.dev.corp.net."),
+		ptr("host1.other.net."),
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "1.0.0.10.in-addr.arpa."}, Target: "host1.corp.net."},
+	}
+	ls.rewritePTRTargets(rrs)
+	s.Equal("host1.dev.corp.net.", rrs[0].(*dns.PTR).Ptr)
+	s.Equal("host2.dev.corp.net.", rrs[1].(*dns.PTR).Ptr)
+	s.Equal("a.b.dev.corp.net.", rrs[2].(*dns.PTR).Ptr)
+	s.Equal("corp.net.", rrs[3].(*dns.PTR).Ptr)
+	s.Equal("host1.dev.corp.net.", rrs[4].(*dns.PTR).Ptr)
+	s.Equal("host1.other.net.", rrs[5].(*dns.PTR).Ptr)
+	s.Equal("host1.corp.net.", rrs[6].(*dns.CNAME).Target)
+}
+
+func (s *LocalStarTestSuite) Test_lookupOnExternalDNS_hosts() {
+	hosts := hostsMap{}
+	hosts.add(net.ParseIP("10.1.1.1"), "test.corp.net")
+	ls := LocalStar{
+		sources: []hostSource{hosts},
+		provider: &stubDNSProvider{exchangeCb: func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+			s.Fail("provider must not be called")
+			return nil, nil
+		}},
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("test.example.com.", dns.TypeA)
+	state := &request.Request{W: &test.ResponseWriter{}, Req: msg}
+	res, err := ls.lookupOnExternalDNS(context.Background(), "test.corp.net.", "test.example.com.", state)
+	if s.NoError(err) && s.NotNil(res) {
+		s.Equal(msg.Id, res.Id)
+		if s.Len(res.Answer, 1) {
+			s.Equal("test.example.com.\t3600\tIN\tA\t10.1.1.1", res.Answer[0].String())
+		}
+	}
+}
+
+func (s *LocalStarTestSuite) Test_lookupOnExternalDNS_ratelimit() {
+	calls := 0
+	ls := LocalStar{
+		ratelimit: &rateLimits{target: newLimiterSet(1, 2)},
+		provider: &stubDNSProvider{exchangeCb: func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+			calls++
+			return msg.Copy(), nil
+		}},
+	}
+	lookup := func (lookupName string) error {
+		msg := new(dns.Msg)
+		msg.SetQuestion("test.example.com.", dns.TypeA)
+		state := &request.Request{W: &test.ResponseWriter{}, Req: msg}
+		_, err := ls.lookupOnExternalDNS(context.Background(), lookupName, "test.example.com.", state)
+		return err
+	}
+	s.NoError(lookup("test.corp.net."))
+	s.NoError(lookup("test.corp.net."))
+	s.ErrorIs(lookup("test.corp.net."), errRateLimited)
+	s.NoError(lookup("other.corp.net."))
+	s.Equal(3, calls)
+
+	// answers from host sources are not limited
+	hosts := hostsMap{}
+	hosts.add(net.ParseIP("10.1.1.1"), "test.corp.net")
+	ls.sources = []hostSource{hosts}
+	s.NoError(lookup("test.corp.net."))
+	s.Equal(3, calls)
+}
+
+func (s *LocalStarTestSuite) Test_randomizeCase() {
+	name := "test-1.corp.net."
+	s.True(strings.EqualFold(name, randomizeCase(name)))
+	changed := false
+	for i := 0; i < 10 && !changed; i++ {
+		changed = randomizeCase(name) != name
+	}
+	s.True(changed)
+	s.Equal("1.2-3.", randomizeCase("1.2-3."))
+}
+
+func (s *LocalStarTestSuite) Test_lookupOnExternalDNS_randomizeCase() {
+	var sent string
+	ls := LocalStar{
+		randomizeCase: true,
+		provider: &stubDNSProvider{exchangeCb: func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+			sent = msg.Question[0].Name
+			res := new(dns.Msg)
+			res.SetReply(msg)
+			res.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: strings.ToLower(sent), Rrtype: dns.TypeA}}}
+			return res, nil
+		}},
+	}
+	lookup := func () (*dns.Msg, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion("Test.Example.com.", dns.TypeA)
+		state := &request.Request{W: &test.ResponseWriter{}, Req: msg}
+		return ls.lookupOnExternalDNS(context.Background(), "test.corp.net.", "Test.Example.com.", state)
+	}
+
+	res, err := lookup()
+	if s.NoError(err) && s.NotNil(res) {
+		s.True(strings.EqualFold("test.corp.net.", sent))
+		s.Equal("Test.Example.com.", res.Question[0].Name)
+		if s.Len(res.Answer, 1) {
+			s.Equal("Test.Example.com.", res.Answer[0].Header().Name)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package localstar
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Variables declared for monitoring.
+var (
+	FilterBlockedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "localstar",
+		Name:      "filter_blocked_total",
+		Help:      "Counter of addresses removed from answers by the filter.",
+	}, []string{"server", "action"})
+	RateLimitedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "localstar",
+		Name:      "ratelimited_total",
+		Help:      "Counter of requests rejected by rate limits.",
+	}, []string{"server", "limit"})
+	InFlightGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "localstar",
+		Name:      "inflight_requests",
+		Help:      "Gauge of upstream exchanges in progress.",
+	}, []string{"server"})
+	MaxConcurrentRejectCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "localstar",
+		Name:      "max_concurrent_rejects_total",
+		Help:      "Counter of requests rejected due to too many concurrent upstream exchanges.",
+	}, []string{"server"})
+	EndpointHealthyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "localstar",
+		Name:      "endpoint_healthy",
+		Help:      "Gauge of endpoint health, 1 if healthy.",
+	}, []string{"endpoint"})
+	HealthCheckFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "localstar",
+		Name:      "health_check_failures_total",
+		Help:      "Counter of failed endpoint health checks.",
+	}, []string{"endpoint"})
+	HedgedRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "localstar",
+		Name:      "hedged_requests_total",
+		Help:      "Counter of queries sent to the next endpoint because of a slow one.",
+	}, []string{"server"})
+	RetryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "localstar",
+		Name:      "retries_total",
+		Help:      "Counter of retried upstream queries.",
+	}, []string{"server"})
+)
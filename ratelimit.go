@@ -0,0 +1,112 @@
+package localstar
+
+// Token bucket rate limits for upstream exchanges.
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const limiterIdleTimeout = 10 * time.Minute
+
+var errRateLimited = errors.New("rate limited")
+
+type rateLimitAction int
+
+const (
+	rateLimitRefused rateLimitAction = iota
+	rateLimitTruncate
+	rateLimitDrop
+)
+
+var rateLimitActions = map[string]rateLimitAction{
+	"refused":  rateLimitRefused,
+	"truncate": rateLimitTruncate,
+	"drop":     rateLimitDrop,
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiterSet keeps a token bucket per key, buckets not used for
+// limiterIdleTimeout are removed.
+type limiterSet struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*limiterEntry
+	lastPurge time.Time
+}
+
+func newLimiterSet(limit float64, burst int) *limiterSet {
+	return &limiterSet{
+		limit:    rate.Limit(limit),
+		burst:    burst,
+		limiters: map[string]*limiterEntry{},
+	}
+}
+
+func (l *limiterSet) allow(key string, now time.Time) bool {
+	return l.reserve(key, now) != nil
+}
+
+// reserve takes a token of key's bucket, it returns nil if the bucket is
+// empty. The token is returned to the bucket by cancelling the reservation.
+func (l *limiterSet) reserve(key string, now time.Time) *rate.Reservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPurge) > limiterIdleTimeout {
+		for k, e := range l.limiters {
+			if now.Sub(e.lastSeen) > limiterIdleTimeout {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastPurge = now
+	}
+	e, ok := l.limiters[key]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = e
+	}
+	e.lastSeen = now
+	r := e.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return nil
+	}
+	if r.DelayFrom(now) > 0 {
+		r.CancelAt(now)
+		return nil
+	}
+	return r
+}
+
+type rateLimits struct {
+	client *limiterSet // keyed by client IP
+	target *limiterSet // keyed by lookup name
+	action rateLimitAction
+}
+
+// allow returns the name of a limit the request exceeds or empty string.
+// Tokens are taken only if the request is within both limits.
+func (r *rateLimits) allow(clientIP, lookupName string) string {
+	now := time.Now()
+	var client *rate.Reservation
+	if r.client != nil {
+		if client = r.client.reserve(clientIP, now); client == nil {
+			return "client"
+		}
+	}
+	if r.target != nil && r.target.reserve(lookupName, now) == nil {
+		if client != nil {
+			client.CancelAt(now)
+		}
+		return "target"
+	}
+	return ""
+}
@@ -0,0 +1,69 @@
+package localstar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RateLimitTestSuite struct {
+	suite.Suite
+}
+
+func TestRateLimitTestSuite(t *testing.T) {
+	suite.Run(t, new(RateLimitTestSuite))
+}
+
+func (s *RateLimitTestSuite) Test_limiterSet() {
+	now := time.Now()
+	l := newLimiterSet(2, 3)
+	for i := 0; i < 3; i++ {
+		s.True(l.allow("a", now))
+	}
+	s.False(l.allow("a", now))
+	s.True(l.allow("b", now))
+
+	// 2 tokens per second
+	s.False(l.allow("a", now.Add(400*time.Millisecond)))
+	s.True(l.allow("a", now.Add(600*time.Millisecond)))
+	s.False(l.allow("a", now.Add(600*time.Millisecond)))
+	s.True(l.allow("a", now.Add(1100*time.Millisecond)))
+}
+
+func (s *RateLimitTestSuite) Test_limiterSet_purge() {
+	now := time.Now()
+	l := newLimiterSet(1, 1)
+	l.allow("a", now)
+	l.allow("b", now.Add(limiterIdleTimeout/2))
+	l.allow("b", now.Add(limiterIdleTimeout))
+	s.Len(l.limiters, 2)
+	l.allow("b", now.Add(limiterIdleTimeout+time.Second))
+	s.Len(l.limiters, 1)
+	s.Contains(l.limiters, "b")
+}
+
+func (s *RateLimitTestSuite) Test_rateLimits() {
+	r := &rateLimits{}
+	s.Equal("", r.allow("10.1.1.1", "host1.corp.net."))
+
+	r = &rateLimits{client: newLimiterSet(1, 1), target: newLimiterSet(1, 2)}
+	s.Equal("", r.allow("10.1.1.1", "host1.corp.net."))
+	s.Equal("client", r.allow("10.1.1.1", "host1.corp.net."))
+	s.Equal("", r.allow("10.1.1.2", "host1.corp.net."))
+	s.Equal("target", r.allow("10.1.1.3", "host1.corp.net."))
+	s.Equal("", r.allow("10.1.1.4", "host2.corp.net."))
+}
+
+func (s *RateLimitTestSuite) Test_rateLimits_noTokenOnReject() {
+	r := &rateLimits{client: newLimiterSet(1, 2), target: newLimiterSet(1, 1)}
+	s.Equal("", r.allow("10.1.1.1", "host1.corp.net."))
+	// rejected by the target limit, the client token is not consumed
+	for i := 0; i < 5; i++ {
+		s.Equal("target", r.allow("10.1.1.1", "host1.corp.net."))
+	}
+	s.Equal("", r.allow("10.1.1.1", "host2.corp.net."))
+	s.Equal("client", r.allow("10.1.1.1", "host3.corp.net."))
+	// rejected by the client limit, the target token is not consumed
+	s.Equal("", r.allow("10.1.1.2", "host3.corp.net."))
+}
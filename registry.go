@@ -0,0 +1,376 @@
+package localstar
+
+// HTTP API which lets developer machines register their addresses.
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultLeaseTTL = 1 * time.Hour
+	defaultMaxLeaseTTL = 24 * time.Hour
+	registryPathPrefix = "/hosts/"
+)
+
+var errBadHostname = errors.New("bad hostname")
+
+type lease struct {
+	Name    string    `json:"name"`
+	IPs     []net.IP  `json:"ips"`
+	Expires time.Time `json:"expires"`
+}
+
+type leaseRequest struct {
+	IPs []net.IP `json:"ips"`
+	TTL int      `json:"ttl"` // in seconds
+}
+
+// registry is a hostSource with leases registered over HTTP.
+type registry struct {
+	addr   string
+	tokens []string
+	path   string
+	maxTTL time.Duration
+	zone   string // relative hostnames are put in this zone
+
+	mu     sync.RWMutex
+	leases map[string]lease
+	now    func() time.Time
+
+	srv *registryServer
+}
+
+func newRegistry() *registry {
+	return &registry{
+		maxTTL: defaultMaxLeaseTTL,
+		leases: map[string]lease{},
+		now:    time.Now,
+	}
+}
+
+func (r *registry) lookup(name string) ([]net.IP, bool) {
+	l, ok := r.get(strings.ToLower(name))
+	return l.IPs, ok
+}
+
+// get returns an active lease.
+func (r *registry) get(host string) (lease, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	l, ok := r.leases[host]
+	if !ok || !l.Expires.After(r.now()) {
+		return lease{}, false
+	}
+	return l, true
+}
+
+// hostname converts a hostname from the API to a lookup name.
+func (r *registry) hostname(host string) (string, error) {
+	host = dns.CanonicalName(host)
+	if _, ok := dns.IsDomainName(host); !ok || host == "." {
+		return "", errBadHostname
+	}
+	if r.zone != "" && !dns.IsSubDomain(r.zone, host) {
+		host = host + r.zone
+	}
+	return host, nil
+}
+
+func (r *registry) put(host string, ips []net.IP, ttl time.Duration) (lease, error) {
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	if ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	l := lease{Name: host, IPs: ips, Expires: r.now().Add(ttl).UTC()}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.leases[host] = l
+	return l, r.save()
+}
+
+func (r *registry) delete(host string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.leases[host]; !ok {
+		return false, nil
+	}
+	delete(r.leases, host)
+	return true, r.save()
+}
+
+// list returns active leases sorted by name.
+func (r *registry) list() []lease {
+	now := r.now()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	leases := []lease{}
+	for _, l := range r.leases {
+		if l.Expires.After(now) {
+			leases = append(leases, l)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Name < leases[j].Name })
+	return leases
+}
+
+// save writes leases to the file, must be called with the lock held.
+func (r *registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	now := r.now()
+	leases := []lease{}
+	for name, l := range r.leases {
+		if !l.Expires.After(now) {
+			delete(r.leases, name)
+			continue
+		}
+		leases = append(leases, l)
+	}
+	data, err := json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+func (r *registry) load() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var leases []lease
+	if err = json.Unmarshal(data, &leases); err != nil {
+		return err
+	}
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range leases {
+		if l.Expires.After(now) {
+			r.leases[l.Name] = l
+		}
+	}
+	return nil
+}
+
+func (r *registry) authorized(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	for _, t := range r.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP implements the http.Handler interface.
+//
+//	GET    /hosts/       list of active leases
+//	GET    /hosts/<name> a single lease
+//	PUT    /hosts/<name> register addresses, body is {"ips": [...], "ttl": <seconds>}
+//	DELETE /hosts/<name> remove a lease
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !r.authorized(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path == strings.TrimSuffix(registryPathPrefix, "/") || req.URL.Path == registryPathPrefix {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, r.list())
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, registryPathPrefix) {
+		http.NotFound(w, req)
+		return
+	}
+	host, err := r.hostname(strings.TrimPrefix(req.URL.Path, registryPathPrefix))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		l, ok := r.get(host)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		writeJSON(w, http.StatusOK, l)
+
+	case http.MethodPut:
+		var lr leaseRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&lr); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(lr.IPs) == 0 {
+			http.Error(w, "bad request: no ips", http.StatusBadRequest)
+			return
+		}
+		l, err := r.put(host, lr.IPs, time.Duration(lr.TTL)*time.Second)
+		if err != nil {
+			log.Errorf("Cannot save registry: %s", err)
+			http.Error(w, "cannot save registry", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, l)
+
+	case http.MethodDelete:
+		ok, err := r.delete(host)
+		if err != nil {
+			log.Errorf("Cannot save registry: %s", err)
+			http.Error(w, "cannot save registry", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (r *registry) start() error {
+	if err := r.load(); err != nil {
+		return err
+	}
+	srv, err := acquireRegistryServer(r.addr, r)
+	if err != nil {
+		return err
+	}
+	r.srv = srv
+	return nil
+}
+
+func (r *registry) stop() error {
+	if r.srv == nil {
+		return nil
+	}
+	err := r.srv.release(r)
+	r.srv = nil
+	return err
+}
+
+// On reload the new instance is started before the old one is stopped,
+// so registries with the same listen address share one HTTP server. Keys
+// of a server block share one registry (see shareSources).
+var (
+	registryServersMu sync.Mutex
+	registryServers   = map[string]*registryServer{}
+)
+
+// registryServer serves the most recently started registry on its address,
+// requests are handed over to the new registry on reload.
+type registryServer struct {
+	addr string
+	srv  *http.Server
+
+	mu   sync.RWMutex
+	regs []*registry // by start order
+}
+
+func acquireRegistryServer(addr string, r *registry) (*registryServer, error) {
+	registryServersMu.Lock()
+	defer registryServersMu.Unlock()
+	rs, ok := registryServers[addr]
+	if !ok {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		rs = &registryServer{addr: addr}
+		rs.srv = &http.Server{Handler: rs, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+		registryServers[addr] = rs
+		go rs.srv.Serve(ln)
+	}
+	rs.mu.Lock()
+	rs.regs = append(rs.regs, r)
+	rs.mu.Unlock()
+	return rs, nil
+}
+
+// release removes the registry and shuts the server down when it was the last one.
+func (rs *registryServer) release(r *registry) error {
+	registryServersMu.Lock()
+	defer registryServersMu.Unlock()
+	rs.mu.Lock()
+	for i, reg := range rs.regs {
+		if reg == r {
+			rs.regs = append(rs.regs[:i], rs.regs[i+1:]...)
+			break
+		}
+	}
+	left := len(rs.regs)
+	rs.mu.Unlock()
+	if left > 0 {
+		return nil
+	}
+	delete(registryServers, rs.addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return rs.srv.Shutdown(ctx)
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (rs *registryServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rs.mu.RLock()
+	var r *registry
+	if len(rs.regs) > 0 {
+		r = rs.regs[len(rs.regs)-1]
+	}
+	rs.mu.RUnlock()
+	if r == nil {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	r.ServeHTTP(w, req)
+}
@@ -0,0 +1,196 @@
+package localstar
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryTestSuite struct {
+	suite.Suite
+	now time.Time
+	reg *registry
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistryTestSuite))
+}
+
+func (s *RegistryTestSuite) SetupTest() {
+	s.now = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.reg = newRegistry()
+	s.reg.tokens = []string{"secret"}
+	s.reg.zone = "corp.net."
+	s.reg.now = func() time.Time { return s.now }
+}
+
+func (s *RegistryTestSuite) request(method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer " + token)
+	}
+	rec := httptest.NewRecorder()
+	s.reg.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *RegistryTestSuite) Test_hostname() {
+	for host, expect := range map[string]string{
+		"host1": "host1.corp.net.",
+		"Host1.": "host1.corp.net.",
+		"host1.corp.net": "host1.corp.net.",
+		"a.host1.corp.net.": "a.host1.corp.net.",
+	}{
+		name, err := s.reg.hostname(host)
+		_ = s.NoError(err, host) && s.Equal(expect, name, host)
+	}
+	for _, host := range []string{"", ".", "a..b"} {
+		_, err := s.reg.hostname(host)
+		s.ErrorIs(err, errBadHostname, host)
+	}
+}
+
+func (s *RegistryTestSuite) Test_auth() {
+	s.Equal(http.StatusUnauthorized, s.request("GET", "/hosts/", "", "").Code)
+	s.Equal(http.StatusUnauthorized, s.request("GET", "/hosts/", "wrong", "").Code)
+	s.Equal(http.StatusUnauthorized, s.request("PUT", "/hosts/host1", "", `{"ips": ["10.1.1.1"]}`).Code)
+	s.Equal(http.StatusOK, s.request("GET", "/hosts/", "secret", "").Code)
+}
+
+func (s *RegistryTestSuite) Test_lease() {
+	rec := s.request("PUT", "/hosts/host1", "secret", `{"ips": ["10.1.1.1", "fd00::1"], "ttl": 60}`)
+	s.Equal(http.StatusOK, rec.Code)
+	s.JSONEq(`{"name": "host1.corp.net.", "ips": ["10.1.1.1", "fd00::1"], "expires": "2021-03-01T12:01:00Z"}`, rec.Body.String())
+
+	ips, ok := s.reg.lookup("HOST1.corp.net.")
+	s.True(ok)
+	s.Equal([]net.IP{net.ParseIP("10.1.1.1"), net.ParseIP("fd00::1")}, ips)
+
+	rec = s.request("GET", "/hosts/host1.corp.net", "secret", "")
+	s.Equal(http.StatusOK, rec.Code)
+	s.JSONEq(`{"name": "host1.corp.net.", "ips": ["10.1.1.1", "fd00::1"], "expires": "2021-03-01T12:01:00Z"}`, rec.Body.String())
+
+	// default and max TTL
+	s.request("PUT", "/hosts/host2", "secret", `{"ips": ["10.1.1.2"]}`)
+	s.reg.maxTTL = 10 * time.Minute
+	s.request("PUT", "/hosts/host3", "secret", `{"ips": ["10.1.1.3"], "ttl": 86400}`)
+	rec = s.request("GET", "/hosts", "secret", "")
+	s.Equal(http.StatusOK, rec.Code)
+	s.JSONEq(`[
+		{"name": "host1.corp.net.", "ips": ["10.1.1.1", "fd00::1"], "expires": "2021-03-01T12:01:00Z"},
+		{"name": "host2.corp.net.", "ips": ["10.1.1.2"], "expires": "2021-03-01T13:00:00Z"},
+		{"name": "host3.corp.net.", "ips": ["10.1.1.3"], "expires": "2021-03-01T12:10:00Z"}
+	]`, rec.Body.String())
+
+	// expiry
+	s.now = s.now.Add(5 * time.Minute)
+	_, ok = s.reg.lookup("host1.corp.net.")
+	s.False(ok)
+	s.Equal(http.StatusNotFound, s.request("GET", "/hosts/host1", "secret", "").Code)
+	rec = s.request("GET", "/hosts/", "secret", "")
+	s.JSONEq(`[
+		{"name": "host2.corp.net.", "ips": ["10.1.1.2"], "expires": "2021-03-01T13:00:00Z"},
+		{"name": "host3.corp.net.", "ips": ["10.1.1.3"], "expires": "2021-03-01T12:10:00Z"}
+	]`, rec.Body.String())
+
+	// delete
+	s.Equal(http.StatusNoContent, s.request("DELETE", "/hosts/host2", "secret", "").Code)
+	s.Equal(http.StatusNotFound, s.request("DELETE", "/hosts/host2", "secret", "").Code)
+	_, ok = s.reg.lookup("host2.corp.net.")
+	s.False(ok)
+}
+
+func (s *RegistryTestSuite) Test_bad_requests() {
+	s.Equal(http.StatusBadRequest, s.request("PUT", "/hosts/host1", "secret", `{"ips": []}`).Code)
+	s.Equal(http.StatusBadRequest, s.request("PUT", "/hosts/host1", "secret", `{"ips": ["10.1.1"]}`).Code)
+	s.Equal(http.StatusBadRequest, s.request("PUT", "/hosts/host1", "secret", `not json`).Code)
+	s.Equal(http.StatusBadRequest, s.request("PUT", "/hosts/a..b", "secret", `{"ips": ["10.1.1.1"]}`).Code)
+	s.Equal(http.StatusMethodNotAllowed, s.request("POST", "/hosts/host1", "secret", "").Code)
+	s.Equal(http.StatusMethodNotAllowed, s.request("DELETE", "/hosts/", "secret", "").Code)
+	s.Equal(http.StatusNotFound, s.request("GET", "/other", "secret", "").Code)
+}
+
+func (s *RegistryTestSuite) Test_persistence() {
+	dir, err := ioutil.TempDir("", "registry")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	s.reg.path = filepath.Join(dir, "registry.json")
+
+	s.NoError(s.reg.load())
+	s.request("PUT", "/hosts/host1", "secret", `{"ips": ["10.1.1.1"], "ttl": 60}`)
+	s.request("PUT", "/hosts/host2", "secret", `{"ips": ["10.1.1.2"], "ttl": 600}`)
+
+	reg := newRegistry()
+	reg.path = s.reg.path
+	reg.now = func() time.Time { return s.now.Add(5 * time.Minute) }
+	if s.NoError(reg.load()) {
+		_, ok := reg.lookup("host1.corp.net.")
+		s.False(ok)
+		ips, ok := reg.lookup("host2.corp.net.")
+		s.True(ok)
+		s.Equal([]net.IP{net.ParseIP("10.1.1.2")}, ips)
+	}
+
+	ioutil.WriteFile(s.reg.path, []byte("not json"), 0644)
+	reg = newRegistry()
+	reg.path = s.reg.path
+	s.Error(reg.load())
+}
+
+func (s *RegistryTestSuite) Test_start() {
+	s.reg.addr = "127.0.0.1:0"
+	s.Require().NoError(s.reg.start())
+	s.NotNil(s.reg.srv)
+	s.NoError(s.reg.stop())
+	s.Nil(s.reg.srv)
+	s.NoError(s.reg.stop())
+}
+
+func (s *RegistryTestSuite) Test_restart() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// spare keep-alive connections would delay the shutdown
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func() int {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/hosts/host1", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a reload starts the new instance before stopping the old one
+	s.reg.addr = addr
+	s.Require().NoError(s.reg.start())
+	s.request("PUT", "/hosts/host1", "secret", `{"ips": ["10.1.1.1"]}`)
+	s.Equal(http.StatusOK, get())
+
+	reg := newRegistry()
+	reg.addr = addr
+	reg.tokens = []string{"secret"}
+	s.Require().NoError(reg.start())
+	s.Equal(http.StatusNotFound, get())
+
+	s.NoError(s.reg.stop())
+	s.Equal(http.StatusNotFound, get())
+	s.NoError(reg.stop())
+	s.Equal(0, get())
+
+	s.Require().NoError(reg.start())
+	s.Equal(http.StatusNotFound, get())
+	s.NoError(reg.stop())
+}
@@ -0,0 +1,94 @@
+package localstar
+
+// Retries of upstream queries.
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+)
+
+const (
+	retryBackoffBase = 10 * time.Millisecond
+	retryBackoffMax  = 500 * time.Millisecond
+)
+
+// retryPolicy defines retries of queries, the total time is bounded by
+// the provider timeout.
+type retryPolicy struct {
+	attempts       int
+	attemptTimeout time.Duration // timeout of providers if zero
+}
+
+// retryable reports whether the query may be sent again: on timeouts,
+// network errors and SERVFAIL, but not on other answers or invalid responses.
+func retryable(res *dns.Msg, err error) bool {
+	if err == nil {
+		return res.Rcode == dns.RcodeServerFailure
+	}
+	code, _ := errorEDE(err)
+	return code == edeNoReachableAuthority || code == edeNetworkError
+}
+
+// backoff returns the delay before the attempt, it grows exponentially
+// with half of it randomized.
+func backoff(attempt int) time.Duration {
+	d := retryBackoffBase << (attempt - 1)
+	if d > retryBackoffMax || d <= 0 {
+		d = retryBackoffMax
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2) + 1))
+}
+
+// rotate returns providers starting with i-th one.
+func rotate(providers []endpointProvider, i int) []endpointProvider {
+	i %= len(providers)
+	return append(append([]endpointProvider{}, providers[i:]...), providers[:i]...)
+}
+
+// exchangeRetry makes up to attempts passes over endpoints, every pass
+// starts with the next endpoint. SERVFAIL is returned if no pass succeeded
+// but one of them got it.
+func (p *compositeDNSProvider) exchangeRetry(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var (res, servfail *dns.Msg; err error)
+	for attempt := 0; attempt < p.retry.attempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(backoff(attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			RetryCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		}
+		providers := p.healthyProviders()
+		if len(providers) == 0 {
+			break
+		}
+		actx, acancel := ctx, context.CancelFunc(func () {})
+		if p.retry.attemptTimeout > 0 {
+			actx, acancel = context.WithTimeout(ctx, p.retry.attemptTimeout)
+		}
+		res, err = p.exchangeOnce(actx, rotate(providers, attempt), msg)
+		acancel()
+		if !retryable(res, err) || ctx.Err() != nil {
+			break
+		}
+		if err == nil {
+			servfail = res
+		}
+	}
+	if err != nil && servfail != nil {
+		return servfail, nil
+	}
+	if err == nil && res == nil {
+		err = ctx.Err()
+	}
+	return res, err
+}
@@ -0,0 +1,164 @@
+package localstar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type RetryTestSuite struct {
+	suite.Suite
+}
+
+func TestRetryTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryTestSuite))
+}
+
+var errNetwork = &net.OpError{Op: "read", Net: "udp", Err: errors.New("connection refused")}
+
+func (s *RetryTestSuite) exchange(p *compositeDNSProvider) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.corp.net.", dns.TypeA)
+	return p.Exchange(context.Background(), msg)
+}
+
+func (s *RetryTestSuite) Test_retryable() {
+	s.False(retryable(&dns.Msg{}, nil))
+	s.False(retryable(&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}, nil))
+	s.True(retryable(&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}, nil))
+	s.True(retryable(nil, context.DeadlineExceeded))
+	s.True(retryable(nil, errNetwork))
+	s.False(retryable(nil, errInvalidResponse))
+	s.False(retryable(nil, context.Canceled))
+}
+
+func (s *RetryTestSuite) Test_backoff() {
+	for attempt, max := range map[int]time.Duration{
+		1: retryBackoffBase, 2: 2 * retryBackoffBase, 3: 4 * retryBackoffBase, 10: retryBackoffMax, 100: retryBackoffMax,
+	}{
+		for i := 0; i < 10; i++ {
+			d := backoff(attempt)
+			s.GreaterOrEqual(int64(d), int64(max / 2), attempt)
+			s.LessOrEqual(int64(d), int64(max), attempt)
+		}
+	}
+}
+
+func (s *RetryTestSuite) Test_exchange() {
+	a, b := &stubProvider{err: errNetwork}, &stubProvider{rcode: dns.RcodeServerFailure}
+	p := &compositeDNSProvider{retry: retryPolicy{attempts: 3}, timeout: time.Second}
+	p.providers = []endpointProvider{a, b}
+	res, err := s.exchange(p)
+	// every pass gets SERVFAIL from b
+	if s.NoError(err) {
+		s.Equal(dns.RcodeServerFailure, res.Rcode)
+	}
+	s.Equal(2, a.count())
+	s.Equal(3, b.count())
+
+	// SERVFAIL wins over later errors
+	calls := 0
+	p.providers = []endpointProvider{&stubDNSProvider{exchangeCb: func (ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		calls++
+		if calls > 1 {
+			return nil, errNetwork
+		}
+		return new(dns.Msg).SetRcode(msg, dns.RcodeServerFailure), nil
+	}}}
+	p.retry.attempts = 2
+	res, err = s.exchange(p)
+	if s.NoError(err) {
+		s.Equal(dns.RcodeServerFailure, res.Rcode)
+	}
+	s.Equal(2, calls)
+
+	// no retries on NXDOMAIN
+	nx := &stubProvider{rcode: dns.RcodeNameError}
+	p.providers = []endpointProvider{nx}
+	p.retry.attempts = 3
+	res, err = s.exchange(p)
+	if s.NoError(err) {
+		s.Equal(dns.RcodeNameError, res.Rcode)
+	}
+	s.Equal(1, nx.count())
+
+	// no retries on invalid responses
+	invalid := &stubProvider{err: errInvalidResponse}
+	p.providers = []endpointProvider{invalid}
+	_, err = s.exchange(p)
+	s.ErrorIs(err, errInvalidResponse)
+	s.Equal(1, invalid.count())
+
+	// network errors are retried until success
+	flaky := &flakyProvider{stubProvider: stubProvider{}, fails: 2}
+	p.providers = []endpointProvider{flaky}
+	res, err = s.exchange(p)
+	if s.NoError(err) {
+		s.Equal(dns.RcodeSuccess, res.Rcode)
+	}
+	s.Equal(3, flaky.count())
+}
+
+func (s *RetryTestSuite) Test_exchange_timeouts() {
+	slow := &stubProvider{delay: time.Second}
+	p := &compositeDNSProvider{retry: retryPolicy{attempts: 3, attemptTimeout: 20 * time.Millisecond}, timeout: time.Second}
+	p.providers = []endpointProvider{slow}
+	start := time.Now()
+	_, err := s.exchange(p)
+	s.ErrorIs(err, context.DeadlineExceeded)
+	s.Equal(3, slow.count())
+	s.GreaterOrEqual(int64(time.Since(start)), int64(60 * time.Millisecond))
+
+	// the total time is bounded by timeout
+	slow = &stubProvider{delay: time.Second}
+	p = &compositeDNSProvider{retry: retryPolicy{attempts: 10, attemptTimeout: 40 * time.Millisecond}, timeout: 100 * time.Millisecond}
+	p.providers = []endpointProvider{slow}
+	start = time.Now()
+	_, err = s.exchange(p)
+	s.ErrorIs(err, context.DeadlineExceeded)
+	s.Less(slow.count(), 4)
+	s.Less(int64(time.Since(start)), int64(150 * time.Millisecond))
+}
+
+func (s *RetryTestSuite) Test_exchange_failoverTimeout() {
+	// failover within a single attempt is bounded by timeout as well
+	var endpoints []string
+	for i := 0; i < 5; i++ {
+		server := startFakeServer(s.T())
+		server.setFaults(fakeFaults{drop: true})
+		endpoints = append(endpoints, server.addr)
+	}
+	p := &compositeDNSProvider{retry: retryPolicy{attempts: 1, attemptTimeout: 100 * time.Millisecond}}
+	s.Require().NoError(p.Init(endpoints, 250 * time.Millisecond))
+	start := time.Now()
+	_, err := s.exchange(p)
+	s.ErrorIs(err, context.DeadlineExceeded)
+	s.InDelta(250 * time.Millisecond, time.Since(start), float64(50 * time.Millisecond))
+}
+
+func (s *RetryTestSuite) Test_Init() {
+	p := &compositeDNSProvider{retry: retryPolicy{attempts: 2, attemptTimeout: 100 * time.Millisecond}}
+	if s.NoError(p.Init([]string{"1.2.3.4:53"}, time.Second)) {
+		s.Equal(time.Second, p.timeout)
+		s.Equal(100 * time.Millisecond, p.providers[0].(*simpleDNSProvider).timeout)
+	}
+}
+
+// flakyProvider fails first queries with a network error.
+type flakyProvider struct {
+	stubProvider
+	fails int
+}
+
+func (p *flakyProvider) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	res, err := p.stubProvider.Exchange(ctx, msg)
+	if p.count() <= p.fails {
+		return nil, errNetwork
+	}
+	return res, err
+}
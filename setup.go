@@ -1,13 +1,20 @@
 package localstar
 
 import (
+	"crypto/tls"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/parse"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
 	"github.com/miekg/dns"
 )
 
@@ -21,6 +28,29 @@ func setup(cc *caddy.Controller) error {
 	if err != nil {
 		return plugin.Error(name, err)
 	}
+	first := shareSources(cc, &ls)
+
+	if ls.updates != nil {
+		ls.updates.handle(ls.fromZone, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			ls.serveUpdate(w, req)
+		}))
+	}
+	for _, src := range ls.sources {
+		switch src.(type) {
+		case *registry, *updateStore:
+			if !first {
+				continue
+			}
+		}
+		if r, ok := src.(runnable); ok {
+			cc.OnStartup(r.start)
+			cc.OnShutdown(r.stop)
+		}
+	}
+	if r, ok := ls.provider.(runnable); ok {
+		cc.OnStartup(r.start)
+		cc.OnShutdown(r.stop)
+	}
 
 	dnsserver.GetConfig(cc).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		ls.next = next
@@ -29,6 +59,40 @@ func setup(cc *caddy.Controller) error {
 	return nil
 }
 
+// blockSources are sources shared by all keys of a server block, so hosts
+// registered once are seen in every zone of the block.
+type blockSources struct {
+	registry *registry
+	updates  *updateStore
+}
+
+// shareSources replaces the registry and the update store of ls with ones
+// of the first key of the server block, which starts them. It reports
+// whether ls is the first key.
+func shareSources(cc *caddy.Controller, ls *LocalStar) bool {
+	block, ok := cc.ServerBlockStorage.(*blockSources)
+	if !ok {
+		block = &blockSources{updates: ls.updates}
+		for _, src := range ls.sources {
+			if r, ok := src.(*registry); ok {
+				block.registry = r
+			}
+		}
+		cc.ServerBlockStorage = block
+		return true
+	}
+	for i, src := range ls.sources {
+		switch src.(type) {
+		case *registry:
+			ls.sources[i] = block.registry
+		case *updateStore:
+			ls.sources[i] = block.updates
+			ls.updates = block.updates
+		}
+	}
+	return false
+}
+
 func parseConfig(cc *caddy.Controller, ls *LocalStar) error {
 	var err error
 	for err == nil && cc.Next() {
@@ -44,6 +108,50 @@ func parseConfig(cc *caddy.Controller, ls *LocalStar) error {
 				err = parseConfigPrefixLen(cc, ls)
 			case "timeout":
 				err = parseConfigTimeout(cc, ls)
+			case "hosts":
+				err = parseConfigHosts(cc, ls)
+			case "hosts_file":
+				err = parseConfigHostsFile(cc, ls)
+			case "registry":
+				err = parseConfigRegistry(cc, ls)
+			case "update_key":
+				err = parseConfigUpdateKey(cc, ls)
+			case "update_listen":
+				err = parseConfigUpdateListen(cc, ls)
+			case "dhcp_leases":
+				err = parseConfigDHCPLeases(cc, ls)
+			case "filter":
+				err = parseConfigFilter(cc, ls)
+			case "allow", "deny":
+				err = parseConfigACLRule(cc, ls)
+			case "deny_action":
+				err = parseConfigDenyAction(cc, ls)
+			case "ratelimit":
+				err = parseConfigRateLimit(cc, ls)
+			case "max_concurrent":
+				err = parseConfigMaxConcurrent(cc, ls)
+			case "randomize_case":
+				ls.randomizeCase = true
+			case "tsig":
+				err = parseConfigTsig(cc, ls)
+			case "ecs":
+				err = parseConfigECS(cc, ls)
+			case "ede_extra_text":
+				ls.edeExtraText = true
+			case "tls":
+				err = parseConfigTLS(cc, ls)
+			case "tls_servername":
+				err = parseConfigTLSServerName(cc, ls)
+			case "health_check":
+				err = parseConfigHealthCheck(cc, ls)
+			case "max_fails":
+				err = parseConfigMaxFails(cc, ls)
+			case "hedge":
+				err = parseConfigHedge(cc, ls)
+			case "attempts":
+				err = parseConfigAttempts(cc, ls)
+			case "attempt_timeout":
+				err = parseConfigAttemptTimeout(cc, ls)
 			}
 
 			if len(cc.RemainingArgs()) > 0 {
@@ -59,6 +167,35 @@ func parseConfig(cc *caddy.Controller, ls *LocalStar) error {
 		return cc.Err("'to_zone' parameter is required")
 	}
 
+	for _, src := range ls.sources {
+		switch src := src.(type) {
+		case *registry:
+			if src.addr == "" {
+				return cc.Err("'registry listen' parameter is required")
+			}
+			if len(src.tokens) == 0 {
+				return cc.Err("'registry token' parameter is required")
+			}
+			src.zone = ls.toZone
+		case *leaseFile:
+			src.zone = ls.toZone
+		case *updateStore:
+			if len(src.keys) == 0 {
+				return cc.Err("'update_key' parameter is required")
+			}
+			if src.addr == "" {
+				return cc.Err("'update_listen' parameter is required")
+			}
+		}
+	}
+
+	if ls.reverse {
+		ls.ptrZone = getForwardZone(cc.ServerBlockKeys)
+		if ls.ptrZone == "" {
+			return cc.Err("reverse zone requires a forward zone in the same server block")
+		}
+	}
+
 	if len(ls.endpoints) < 1 {
 		ls.endpoints, err = parse.HostPortOrFile(ls.defaultEndpoints...)
 		if err != nil || len(ls.endpoints) < 1 {
@@ -66,7 +203,14 @@ func parseConfig(cc *caddy.Controller, ls *LocalStar) error {
 		}
 	}
 
-	ls.provider = new(simpleDNSProvider)
+	ls.provider = &compositeDNSProvider{
+		opts: providerOptions{tsig: ls.tsig, tlsConfig: ls.tlsConfig},
+		check: ls.healthCheck,
+		hedge: ls.hedge,
+		retry: ls.retry,
+		limit: ls.concurrency,
+		matchCase: ls.randomizeCase,
+	}
 	if err = ls.provider.Init(ls.endpoints, ls.timeout); err != nil {
 		return cc.Errf("cannot init provider: %s", err.Error())
 	}
@@ -129,3 +273,498 @@ func parseConfigTimeout(cc *caddy.Controller, ls *LocalStar) (err error) {
 	}
 	return nil
 }
+
+func parseConfigHosts(cc *caddy.Controller, ls *LocalStar) error {
+	args := cc.RemainingArgs()
+	if len(args) < 2 {
+		return cc.ArgErr()
+	}
+	ip, names := parseHostsLine(strings.Join(args, " "))
+	if ip == nil {
+		return cc.Errf("invalid address: %q", args[0])
+	}
+	// all inline entries share the same source
+	var hosts hostsMap
+	for _, src := range ls.sources {
+		if m, ok := src.(hostsMap); ok {
+			hosts = m
+		}
+	}
+	if hosts == nil {
+		hosts = hostsMap{}
+		ls.sources = append(ls.sources, hosts)
+	}
+	hosts.add(ip, names...)
+	return nil
+}
+
+func parseConfigHostsFile(cc *caddy.Controller, ls *LocalStar) error {
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	path := cc.Val()
+	if !filepath.IsAbs(path) && dnsserver.GetConfig(cc).Root != "" {
+		path = filepath.Join(dnsserver.GetConfig(cc).Root, path)
+	}
+	f, err := newWatchedFile(path, parseHostsFile)
+	if err != nil {
+		return cc.Errf("cannot read hosts file: %s", err)
+	}
+	ls.sources = append(ls.sources, f)
+	return nil
+}
+
+func parseConfigRegistry(cc *caddy.Controller, ls *LocalStar) error {
+	var reg *registry
+	for _, src := range ls.sources {
+		if r, ok := src.(*registry); ok {
+			reg = r
+		}
+	}
+	if reg == nil {
+		reg = newRegistry()
+		ls.sources = append(ls.sources, reg)
+	}
+
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	switch cc.Val() {
+	default:
+		return cc.Errf("unknown registry property: '%s'", cc.Val())
+	case "listen":
+		if !cc.NextArg() {
+			return cc.ArgErr()
+		}
+		if _, _, err := net.SplitHostPort(cc.Val()); err != nil {
+			return cc.Errf("invalid listen address: %q", cc.Val())
+		}
+		reg.addr = cc.Val()
+	case "token", "tokens":
+		tokens := cc.RemainingArgs()
+		if len(tokens) == 0 {
+			return cc.ArgErr()
+		}
+		reg.tokens = append(reg.tokens, tokens...)
+	case "file":
+		if !cc.NextArg() {
+			return cc.ArgErr()
+		}
+		reg.path = cc.Val()
+		if !filepath.IsAbs(reg.path) && dnsserver.GetConfig(cc).Root != "" {
+			reg.path = filepath.Join(dnsserver.GetConfig(cc).Root, reg.path)
+		}
+	case "max_ttl":
+		if !cc.NextArg() {
+			return cc.ArgErr()
+		}
+		ttl, err := time.ParseDuration(cc.Val())
+		if err != nil {
+			return cc.Errf("invalid duration: %q", cc.Val())
+		}
+		if ttl <= 0 {
+			return cc.Errf("max_ttl must be positive: %s", ttl)
+		}
+		reg.maxTTL = ttl
+	}
+	return nil
+}
+
+func parseConfigUpdateKey(cc *caddy.Controller, ls *LocalStar) error {
+	args := cc.RemainingArgs()
+	if len(args) != 3 {
+		return cc.ArgErr()
+	}
+	key, err := newTsigKey(args[0], args[1], args[2])
+	if err != nil {
+		return cc.Errf("invalid key %q: %s", args[0], err)
+	}
+	if ls.updates == nil {
+		ls.updates = newUpdateStore()
+		ls.sources = append(ls.sources, ls.updates)
+	}
+	ls.updates.keys[key.name] = key
+	return nil
+}
+
+func parseConfigUpdateListen(cc *caddy.Controller, ls *LocalStar) error {
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	if _, _, err := net.SplitHostPort(cc.Val()); err != nil {
+		return cc.Errf("invalid listen address: %q", cc.Val())
+	}
+	if ls.updates == nil {
+		ls.updates = newUpdateStore()
+		ls.sources = append(ls.sources, ls.updates)
+	}
+	ls.updates.addr = cc.Val()
+	return nil
+}
+
+// parseConfigTsig parses "tsig <name> <algorithm> <secret>" or
+// "tsig <key file>".
+func parseConfigTsig(cc *caddy.Controller, ls *LocalStar) error {
+	var (
+		key tsigKey
+		err error
+	)
+	switch args := cc.RemainingArgs(); len(args) {
+	case 1:
+		path := args[0]
+		if !filepath.IsAbs(path) && dnsserver.GetConfig(cc).Root != "" {
+			path = filepath.Join(dnsserver.GetConfig(cc).Root, path)
+		}
+		var f *os.File
+		if f, err = os.Open(path); err != nil {
+			return cc.Errf("cannot read key file: %s", err)
+		}
+		key, err = parseTsigKeyFile(f)
+		f.Close()
+	case 3:
+		key, err = newTsigKey(args[0], args[1], args[2])
+	default:
+		return cc.ArgErr()
+	}
+	if err != nil {
+		return cc.Errf("invalid TSIG key: %s", err)
+	}
+	ls.tsig = &key
+	return nil
+}
+
+// parseConfigECS parses "ecs strip|forward|synthesize [v4 prefix [v6 prefix]]".
+func parseConfigECS(cc *caddy.Controller, ls *LocalStar) error {
+	args := cc.RemainingArgs()
+	if len(args) < 1 {
+		return cc.ArgErr()
+	}
+	mode, ok := ecsModes[args[0]]
+	if !ok {
+		return cc.Errf("unknown ecs mode: %q", args[0])
+	}
+	if len(args) > 1 && mode != ecsSynthesize || len(args) > 3 {
+		return cc.ArgErr()
+	}
+	ls.edns.ecs = mode
+	prefixes := []*uint8{&ls.edns.prefixV4, &ls.edns.prefixV6}
+	maxBits := []int{net.IPv4len * 8, net.IPv6len * 8}
+	for i, arg := range args[1:] {
+		prefix, err := strconv.Atoi(arg)
+		if err != nil || prefix < 0 || prefix > maxBits[i] {
+			return cc.Errf("invalid prefix length: %q", arg)
+		}
+		*prefixes[i] = uint8(prefix)
+	}
+	return nil
+}
+
+// parseConfigTLS parses "tls [cert key] [ca]" for connections to endpoints.
+func parseConfigTLS(cc *caddy.Controller, ls *LocalStar) error {
+	args := cc.RemainingArgs()
+	if len(args) > 3 {
+		return cc.ArgErr()
+	}
+	for i := range args {
+		if !filepath.IsAbs(args[i]) && dnsserver.GetConfig(cc).Root != "" {
+			args[i] = filepath.Join(dnsserver.GetConfig(cc).Root, args[i])
+		}
+	}
+	serverName := ""
+	if ls.tlsConfig != nil {
+		serverName = ls.tlsConfig.ServerName
+	}
+	tlsConfig, err := pkgtls.NewTLSConfigFromArgs(args...)
+	if err != nil {
+		return cc.Errf("invalid tls config: %s", err)
+	}
+	tlsConfig.ServerName = serverName
+	ls.tlsConfig = tlsConfig
+	return nil
+}
+
+func parseConfigTLSServerName(cc *caddy.Controller, ls *LocalStar) error {
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	if ls.tlsConfig == nil {
+		ls.tlsConfig = new(tls.Config)
+	}
+	ls.tlsConfig.ServerName = cc.Val()
+	return nil
+}
+
+// parseConfigHealthCheck parses "health_check <interval> [<name> [<type>]]".
+func parseConfigHealthCheck(cc *caddy.Controller, ls *LocalStar) error {
+	args := cc.RemainingArgs()
+	if len(args) < 1 || len(args) > 3 {
+		return cc.ArgErr()
+	}
+	interval, err := time.ParseDuration(args[0])
+	if err != nil {
+		return cc.Errf("invalid duration: %q", args[0])
+	}
+	if interval <= 0 {
+		return cc.Errf("health check interval must be positive: %s", interval)
+	}
+	ls.healthCheck.interval = interval
+	if len(args) > 1 {
+		ls.healthCheck.name = dns.Fqdn(args[1])
+		if _, ok := dns.IsDomainName(ls.healthCheck.name); !ok {
+			return cc.Errf("invalid probe name: %q", args[1])
+		}
+	}
+	if len(args) > 2 {
+		qtype, ok := dns.StringToType[strings.ToUpper(args[2])]
+		if !ok {
+			return cc.Errf("unknown query type: %q", args[2])
+		}
+		ls.healthCheck.qtype = qtype
+	}
+	return nil
+}
+
+func parseConfigMaxFails(cc *caddy.Controller, ls *LocalStar) error {
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	n, err := strconv.ParseUint(cc.Val(), 10, 31)
+	if err != nil {
+		return cc.Errf("invalid number: %q", cc.Val())
+	}
+	ls.healthCheck.maxFails = int32(n)
+	return nil
+}
+
+// parseConfigHedge parses "hedge <delay>" and "hedge p<percentile> [<delay>]",
+// the delay is used until enough latencies are observed in the latter.
+func parseConfigHedge(cc *caddy.Controller, ls *LocalStar) error {
+	args := cc.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return cc.ArgErr()
+	}
+	if strings.HasPrefix(args[0], "p") {
+		n, err := strconv.Atoi(args[0][1:])
+		if err != nil || n < 1 || n > 100 {
+			return cc.Errf("invalid percentile: %q", args[0])
+		}
+		ls.hedge.percentile = n
+		args = args[1:]
+	} else if len(args) > 1 {
+		return cc.ArgErr()
+	}
+	if len(args) > 0 {
+		delay, err := time.ParseDuration(args[0])
+		if err != nil {
+			return cc.Errf("invalid duration: %q", args[0])
+		}
+		if delay <= 0 {
+			return cc.Errf("hedge delay must be positive: %s", delay)
+		}
+		ls.hedge.delay = delay
+	}
+	return nil
+}
+
+func parseConfigAttempts(cc *caddy.Controller, ls *LocalStar) error {
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	n, err := strconv.Atoi(cc.Val())
+	if err != nil || n < 1 {
+		return cc.Errf("invalid number of attempts: %q", cc.Val())
+	}
+	ls.retry.attempts = n
+	return nil
+}
+
+func parseConfigAttemptTimeout(cc *caddy.Controller, ls *LocalStar) error {
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	timeout, err := time.ParseDuration(cc.Val())
+	if err != nil {
+		return cc.Errf("invalid duration: %q", cc.Val())
+	}
+	if timeout <= 0 {
+		return cc.Errf("attempt timeout must be positive: %s", timeout)
+	}
+	ls.retry.attemptTimeout = timeout
+	return nil
+}
+
+func parseConfigDHCPLeases(cc *caddy.Controller, ls *LocalStar) error {
+	args := cc.RemainingArgs()
+	if len(args) != 2 {
+		return cc.ArgErr()
+	}
+	format, path := args[0], args[1]
+	if _, ok := leaseParsers[format]; !ok {
+		return cc.Errf("unknown lease file format: %q", format)
+	}
+	if !filepath.IsAbs(path) && dnsserver.GetConfig(cc).Root != "" {
+		path = filepath.Join(dnsserver.GetConfig(cc).Root, path)
+	}
+	f, err := newLeaseFile(path, format)
+	if err != nil {
+		return cc.Errf("cannot read lease file: %s", err)
+	}
+	ls.sources = append(ls.sources, f)
+	return nil
+}
+
+func parseConfigFilter(cc *caddy.Controller, ls *LocalStar) error {
+	if ls.filter == nil {
+		ls.filter = &addrFilter{action: filterDrop}
+	}
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	switch cc.Val() {
+	default:
+		return cc.Errf("unknown filter property: '%s'", cc.Val())
+	case "allow", "deny":
+		prop := cc.Val()
+		args := cc.RemainingArgs()
+		if len(args) == 0 {
+			return cc.ArgErr()
+		}
+		nets, err := parseNets(args)
+		if err != nil {
+			return cc.Errf("invalid network: %s", err)
+		}
+		if prop == "allow" {
+			ls.filter.allow = append(ls.filter.allow, nets...)
+		} else {
+			ls.filter.deny = append(ls.filter.deny, nets...)
+		}
+	case "action":
+		if !cc.NextArg() {
+			return cc.ArgErr()
+		}
+		action, ok := filterActions[cc.Val()]
+		if !ok {
+			return cc.Errf("unknown filter action: %q", cc.Val())
+		}
+		ls.filter.action = action
+	}
+	return nil
+}
+
+// parseConfigACLRule parses "allow|deny [type QTYPE...] [net CIDR...]".
+func parseConfigACLRule(cc *caddy.Controller, ls *LocalStar) error {
+	rule := aclRule{allow: cc.Val() == "allow", qtypes: map[uint16]bool{}}
+	var list string
+	for _, arg := range cc.RemainingArgs() {
+		switch {
+		case arg == "type" || arg == "net":
+			list = arg
+		case list == "type":
+			qtype, ok := dns.StringToType[strings.ToUpper(arg)]
+			if !ok {
+				return cc.Errf("invalid query type: %q", arg)
+			}
+			rule.qtypes[qtype] = true
+		case list == "net":
+			nets, err := parseNets([]string{arg})
+			if err != nil {
+				return cc.Errf("invalid network: %s", err)
+			}
+			rule.nets = append(rule.nets, nets...)
+		default:
+			return cc.Errf("unexpected argument: %q", arg)
+		}
+	}
+	if ls.acl == nil {
+		ls.acl = &clientACL{}
+	}
+	ls.acl.rules = append(ls.acl.rules, rule)
+	return nil
+}
+
+func parseConfigDenyAction(cc *caddy.Controller, ls *LocalStar) error {
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	if ls.acl == nil {
+		ls.acl = &clientACL{}
+	}
+	switch cc.Val() {
+	case "refused":
+		ls.acl.drop = false
+	case "drop":
+		ls.acl.drop = true
+	default:
+		return cc.Errf("unknown deny action: %q", cc.Val())
+	}
+	return nil
+}
+
+func parseConfigRateLimit(cc *caddy.Controller, ls *LocalStar) error {
+	if ls.ratelimit == nil {
+		ls.ratelimit = &rateLimits{action: rateLimitRefused}
+	}
+	if !cc.NextArg() {
+		return cc.ArgErr()
+	}
+	switch cc.Val() {
+	default:
+		return cc.Errf("unknown ratelimit property: '%s'", cc.Val())
+	case "client", "target":
+		key := cc.Val()
+		args := cc.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return cc.ArgErr()
+		}
+		limit, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || limit <= 0 {
+			return cc.Errf("invalid rate: %q", args[0])
+		}
+		burst := int(math.Ceil(limit))
+		if len(args) > 1 {
+			if burst, err = strconv.Atoi(args[1]); err != nil || burst < 1 {
+				return cc.Errf("invalid burst: %q", args[1])
+			}
+		}
+		if key == "client" {
+			ls.ratelimit.client = newLimiterSet(limit, burst)
+		} else {
+			ls.ratelimit.target = newLimiterSet(limit, burst)
+		}
+	case "action":
+		if !cc.NextArg() {
+			return cc.ArgErr()
+		}
+		action, ok := rateLimitActions[cc.Val()]
+		if !ok {
+			return cc.Errf("unknown ratelimit action: %q", cc.Val())
+		}
+		ls.ratelimit.action = action
+	}
+	return nil
+}
+
+func parseConfigMaxConcurrent(cc *caddy.Controller, ls *LocalStar) error {
+	args := cc.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return cc.ArgErr()
+	}
+	max, err := strconv.Atoi(args[0])
+	if err != nil {
+		return cc.Errf("invalid number: %q", args[0])
+	}
+	if max < 1 {
+		return cc.Errf("max_concurrent can't be less than 1: %d", max)
+	}
+	var wait time.Duration
+	if len(args) > 1 {
+		if wait, err = time.ParseDuration(args[1]); err != nil {
+			return cc.Errf("invalid duration: %q", args[1])
+		}
+		if wait < 0 {
+			return cc.Errf("queue timeout can't be negative: %s", wait)
+		}
+	}
+	ls.concurrency = newConcurrencyLimit(max, wait)
+	return nil
+}
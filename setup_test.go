@@ -214,3 +214,761 @@ func (s *SetupTestSuite) Test_timeout() {
 	s.ErrContains(parseErr("10"), "invalid duration")
 	s.ErrContains(parseErr("-10s"), "timeout can't be negative")
 }
+
+func (s *SetupTestSuite) Test_reverse() {
+	parse := func (zone string, keys []string) (LocalStar, error) {
+		ls := newLocalStar(&dnsserver.Config{Zone: dns.CanonicalName(zone)})
+		ls.defaultEndpoints = []string{"10.20.30.40"}
+		cc := caddy.NewTestController("dns", `localstar {
+			to_zone corp.net
+		}`)
+		cc.ServerBlockKeys = keys
+		return ls, parseConfig(cc, &ls)
+	}
+
+	ls, err := parse("dev.corp.net", []string{"dev.corp.net", "10.in-addr.arpa"})
+	if s.NoError(err) {
+		s.False(ls.reverse)
+		s.Equal("", ls.ptrZone)
+	}
+
+	ls, err = parse("10.in-addr.arpa", []string{"dev.corp.net", "10.in-addr.arpa"})
+	if s.NoError(err) {
+		s.True(ls.reverse)
+		s.Equal("dev.corp.net.", ls.ptrZone)
+	}
+
+	ls, err = parse("8.b.d.0.1.0.0.2.ip6.arpa", []string{"2001:db8::/32", "dev.corp.net"})
+	if s.NoError(err) {
+		s.True(ls.reverse)
+		s.Equal("dev.corp.net.", ls.ptrZone)
+	}
+
+	_, err = parse("10.in-addr.arpa", []string{"10.in-addr.arpa"})
+	s.ErrContains(err, "reverse zone requires a forward zone")
+}
+
+func (s *SetupTestSuite) Test_hosts() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		hosts 10.1.1.1 host1.corp.net host1-alias.corp.net
+		hosts fd00::1 host1.corp.net
+	}`)
+	if s.NoError(err) && s.Len(ls.sources, 1) {
+		ips, ok := ls.sources[0].lookup("host1.corp.net.")
+		s.True(ok)
+		s.Len(ips, 2)
+		_, ok = ls.sources[0].lookup("host1-alias.corp.net.")
+		s.True(ok)
+	}
+
+	parse := func (args string) error {
+		_, err := s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			hosts ` + args + `
+		}`)
+		return err
+	}
+	s.ErrContains(parse(""), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("10.1.1.1"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("host1.corp.net 10.1.1.1"), "invalid address")
+}
+
+func (s *SetupTestSuite) Test_hosts_file() {
+	tmpfile, err := ioutil.TempFile("", "hosts.*")
+	s.Require().NoError(err)
+	hostsFile := tmpfile.Name()
+	defer os.Remove(hostsFile)
+	tmpfile.WriteString("10.1.1.1 host1.corp.net\n")
+	tmpfile.Close()
+
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		hosts 10.1.1.2 host2.corp.net
+		hosts_file ` + hostsFile + `
+	}`)
+	if s.NoError(err) && s.Len(ls.sources, 2) {
+		s.IsType(hostsMap{}, ls.sources[0])
+		s.IsType(&watchedFile{}, ls.sources[1])
+		_, ok := ls.sources[1].lookup("host1.corp.net.")
+		s.True(ok)
+	}
+
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		hosts_file
+	}`)
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		hosts_file ` + hostsFile + `.missing
+	}`)
+	s.ErrContains(err, "cannot read hosts file")
+}
+
+func (s *SetupTestSuite) Test_registry() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		registry listen :8089
+		registry token secret1 secret2
+		registry file /var/lib/localstar/registry.json
+		registry max_ttl 2h
+	}`)
+	if s.NoError(err) && s.Len(ls.sources, 1) {
+		reg, ok := ls.sources[0].(*registry)
+		if s.True(ok) {
+			s.Equal(":8089", reg.addr)
+			s.Equal([]string{"secret1", "secret2"}, reg.tokens)
+			s.Equal("/var/lib/localstar/registry.json", reg.path)
+			s.Equal(2*time.Hour, reg.maxTTL)
+			s.Equal("corp.net.", reg.zone)
+		}
+	}
+
+	parse := func (lines string) error {
+		_, err := s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			` + lines + `
+		}`)
+		return err
+	}
+	s.NoError(parse("registry listen :8089\nregistry token secret"))
+	s.ErrContains(parse("registry token secret"), "'registry listen' parameter is required")
+	s.ErrContains(parse("registry listen :8089"), "'registry token' parameter is required")
+	s.ErrContains(parse("registry"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("registry listen"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("registry listen 8089"), "invalid listen address")
+	s.ErrContains(parse("registry token"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("registry max_ttl string"), "invalid duration")
+	s.ErrContains(parse("registry max_ttl 0s"), "max_ttl must be positive")
+	s.ErrContains(parse("registry other"), "unknown registry property")
+}
+
+// setupBlock runs setup for every key of a server block as caddy does, it
+// returns plugin instances by key.
+func (s *SetupTestSuite) setupBlock(keys []string, input string) []LocalStar {
+	var (res []LocalStar; storage interface{})
+	for i, key := range keys {
+		cc := caddy.NewTestController("dns", input)
+		cc.ServerBlockKeys = keys
+		cc.ServerBlockKeyIndex = i
+		cc.ServerBlockStorage = storage
+		dnsserver.GetConfig(cc).Zone = dns.CanonicalName(key)
+		s.Require().NoError(setup(cc))
+		storage = cc.ServerBlockStorage
+		plugins := dnsserver.GetConfig(cc).Plugin
+		res = append(res, plugins[len(plugins)-1](nil).(LocalStar))
+	}
+	return res
+}
+
+func (s *SetupTestSuite) Test_shared_sources() {
+	ls := s.setupBlock([]string{"dev.corp.net", "10.in-addr.arpa"}, `localstar {
+		to_zone corp.net
+		endpoint 10.20.30.40
+		registry listen 127.0.0.1:8089
+		registry token secret
+		hosts 10.1.1.1 host1
+		update_key key1 hmac-sha256 c2VjcmV0
+		update_listen 127.0.0.1:5353
+	}`)
+	if s.Len(ls, 2) && s.Len(ls[0].sources, 3) && s.Len(ls[1].sources, 3) {
+		s.IsType(&registry{}, ls[0].sources[0])
+		s.Same(ls[0].sources[0], ls[1].sources[0])
+		s.Same(ls[0].updates, ls[1].updates)
+		s.Same(ls[0].updates, ls[1].sources[2])
+		s.Equal([]string{"dev.corp.net.", "10.in-addr.arpa."}, ls[0].updates.zones)
+	}
+}
+
+func (s *SetupTestSuite) Test_update_key() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		update_key key1 hmac-sha256 c2VjcmV0
+		update_key Key2. hmac-sha512. c2VjcmV0
+		update_listen 127.0.0.1:5353
+	}`)
+	if s.NoError(err) && s.NotNil(ls.updates) {
+		s.Equal([]hostSource{ls.updates}, ls.sources)
+		s.Equal("127.0.0.1:5353", ls.updates.addr)
+		s.Equal(map[string]tsigKey{
+			"key1.": {"key1.", dns.HmacSHA256, "c2VjcmV0"},
+			"key2.": {"key2.", dns.HmacSHA512, "c2VjcmV0"},
+		}, ls.updates.keys)
+	}
+
+	parse := func (args string) error {
+		_, err := s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			update_listen :5353
+			update_key ` + args + `
+		}`)
+		return err
+	}
+	s.ErrContains(parse(""), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("key1 hmac-sha256"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("key1 hmac-md5 c2VjcmV0"), "unsupported TSIG algorithm")
+	s.ErrContains(parse("key1 hmac-sha256 not-base64!"), "not base64 encoded")
+
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		update_key key1 hmac-sha256 c2VjcmV0
+	}`)
+	s.ErrContains(err, "'update_listen' parameter is required")
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		update_listen :5353
+	}`)
+	s.ErrContains(err, "'update_key' parameter is required")
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		update_listen 5353
+	}`)
+	s.ErrContains(err, "invalid listen address")
+}
+
+func (s *SetupTestSuite) Test_dhcp_leases() {
+	tmpfile, err := ioutil.TempFile("", "dnsmasq.leases.*")
+	s.Require().NoError(err)
+	leasesFile := tmpfile.Name()
+	defer os.Remove(leasesFile)
+	tmpfile.WriteString("0 00:11:22:33:44:55 10.1.1.1 host1 *\n")
+	tmpfile.Close()
+
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		dhcp_leases dnsmasq ` + leasesFile + `
+		dhcp_leases dhcpd ` + leasesFile + `
+	}`)
+	if s.NoError(err) && s.Len(ls.sources, 2) {
+		f, ok := ls.sources[0].(*leaseFile)
+		if s.True(ok) {
+			s.Equal("corp.net.", f.zone)
+			_, ok = f.lookup("host1.corp.net.")
+			s.True(ok)
+		}
+	}
+
+	parse := func (args string) error {
+		_, err := s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			dhcp_leases ` + args + `
+		}`)
+		return err
+	}
+	s.ErrContains(parse(""), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("dnsmasq"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("kea " + leasesFile), "unknown lease file format")
+	s.ErrContains(parse("dnsmasq " + leasesFile + ".missing"), "cannot read lease file")
+}
+
+func (s *SetupTestSuite) Test_filter() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.Nil(ls.filter)
+	}
+
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		filter allow private
+		filter allow 100.64.0.0/10
+		filter deny 10.10.0.0/16 10.20.1.1
+	}`)
+	if s.NoError(err) && s.NotNil(ls.filter) {
+		s.Len(ls.filter.allow, 5)
+		s.Len(ls.filter.deny, 2)
+		s.Equal(filterDrop, ls.filter.action)
+	}
+
+	parse := func (args string) (LocalStar, error) {
+		return s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			filter ` + args + `
+		}`)
+	}
+	for name, action := range filterActions {
+		ls, err = parse("action " + name)
+		if s.NoError(err) && s.NotNil(ls.filter) {
+			s.Equal(action, ls.filter.action)
+			s.Equal(name, action.String())
+		}
+	}
+
+	_, err = parse("")
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = parse("allow")
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = parse("deny 10.0.0.0/33")
+	s.ErrContains(err, "invalid network")
+	_, err = parse("action")
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = parse("action servfail")
+	s.ErrContains(err, "unknown filter action")
+	_, err = parse("other")
+	s.ErrContains(err, "unknown filter property")
+}
+
+func (s *SetupTestSuite) Test_acl() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.Nil(ls.acl)
+	}
+
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		allow net 10.1.0.0/16 fd00::/8
+		allow type A aaaa net 10.8.0.0/16
+		deny type ANY
+		deny
+		deny_action drop
+	}`)
+	if s.NoError(err) && s.NotNil(ls.acl) && s.Len(ls.acl.rules, 4) {
+		s.True(ls.acl.drop)
+		r := ls.acl.rules
+		s.True(r[0].allow)
+		s.Empty(r[0].qtypes)
+		s.Len(r[0].nets, 2)
+		s.True(r[1].allow)
+		s.Equal(map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true}, r[1].qtypes)
+		s.Len(r[1].nets, 1)
+		s.False(r[2].allow)
+		s.Equal(map[uint16]bool{dns.TypeANY: true}, r[2].qtypes)
+		s.Empty(r[2].nets)
+		s.False(r[3].allow)
+		s.Empty(r[3].qtypes)
+		s.Empty(r[3].nets)
+	}
+
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		deny_action refused
+	}`)
+	if s.NoError(err) && s.NotNil(ls.acl) {
+		s.False(ls.acl.drop)
+	}
+
+	parse := func (line string) error {
+		_, err := s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			` + line + `
+		}`)
+		return err
+	}
+	s.ErrContains(parse("allow 10.0.0.0/8"), "unexpected argument")
+	s.ErrContains(parse("allow type BAD"), "invalid query type")
+	s.ErrContains(parse("deny net 10.0.0.0/33"), "invalid network")
+	s.ErrContains(parse("deny_action"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("deny_action servfail"), "unknown deny action")
+}
+
+func (s *SetupTestSuite) Test_ratelimit() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.Nil(ls.ratelimit)
+	}
+
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		ratelimit client 10 20
+		ratelimit target 0.5
+		ratelimit action truncate
+	}`)
+	if s.NoError(err) && s.NotNil(ls.ratelimit) {
+		s.Equal(rateLimitTruncate, ls.ratelimit.action)
+		if s.NotNil(ls.ratelimit.client) {
+			s.EqualValues(10, ls.ratelimit.client.limit)
+			s.Equal(20, ls.ratelimit.client.burst)
+		}
+		if s.NotNil(ls.ratelimit.target) {
+			s.EqualValues(0.5, ls.ratelimit.target.limit)
+			s.Equal(1, ls.ratelimit.target.burst)
+		}
+	}
+
+	parse := func (args string) error {
+		_, err := s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			ratelimit ` + args + `
+		}`)
+		return err
+	}
+	s.NoError(parse("action drop"))
+	s.NoError(parse("action refused"))
+	s.ErrContains(parse(""), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("client"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("client 1 2 3"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("client string"), "invalid rate")
+	s.ErrContains(parse("target 0"), "invalid rate")
+	s.ErrContains(parse("target 10 0"), "invalid burst")
+	s.ErrContains(parse("action"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("action servfail"), "unknown ratelimit action")
+	s.ErrContains(parse("other"), "unknown ratelimit property")
+}
+
+func (s *SetupTestSuite) Test_max_concurrent() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.Nil(ls.concurrency)
+	}
+
+	parse := func (args string) (LocalStar, error) {
+		return s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			max_concurrent ` + args + `
+		}`)
+	}
+	ls, err = parse("100")
+	if s.NoError(err) && s.NotNil(ls.concurrency) {
+		s.Equal(100, cap(ls.concurrency.slots))
+		s.Equal(time.Duration(0), ls.concurrency.wait)
+		s.Equal(ls.concurrency, ls.provider.(*compositeDNSProvider).limit)
+	}
+	ls, err = parse("10 500ms")
+	if s.NoError(err) && s.NotNil(ls.concurrency) {
+		s.Equal(10, cap(ls.concurrency.slots))
+		s.Equal(500*time.Millisecond, ls.concurrency.wait)
+	}
+
+	_, err = parse("")
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = parse("10 1s 2")
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = parse("string")
+	s.ErrContains(err, "invalid number")
+	_, err = parse("0")
+	s.ErrContains(err, "max_concurrent can't be less than 1")
+	_, err = parse("10 string")
+	s.ErrContains(err, "invalid duration")
+	_, err = parse("10 -1s")
+	s.ErrContains(err, "queue timeout can't be negative")
+}
+
+func (s *SetupTestSuite) Test_randomize_case() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.False(ls.randomizeCase)
+		s.False(ls.provider.(*compositeDNSProvider).matchCase)
+	}
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		randomize_case
+	}`)
+	if s.NoError(err) {
+		s.True(ls.randomizeCase)
+		s.True(ls.provider.(*compositeDNSProvider).matchCase)
+	}
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		randomize_case on
+	}`)
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+}
+
+func (s *SetupTestSuite) Test_tsig() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.Nil(ls.tsig)
+		s.Nil(ls.provider.(*compositeDNSProvider).opts.tsig)
+	}
+
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		tsig Key1 hmac-sha256 c2VjcmV0
+	}`)
+	if s.NoError(err) && s.NotNil(ls.tsig) {
+		s.Equal(tsigKey{"key1.", dns.HmacSHA256, "c2VjcmV0"}, *ls.tsig)
+		s.Equal(ls.tsig, ls.provider.(*compositeDNSProvider).opts.tsig)
+	}
+
+	tmpfile, err := ioutil.TempFile("", "tsig.key.*")
+	s.Require().NoError(err)
+	keyFile := tmpfile.Name()
+	defer os.Remove(keyFile)
+	tmpfile.WriteString("key \"key2\" {\n\talgorithm hmac-sha512;\n\tsecret \"c2VjcmV0\";\n};\n")
+	tmpfile.Close()
+
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		tsig ` + keyFile + `
+	}`)
+	if s.NoError(err) && s.NotNil(ls.tsig) {
+		s.Equal(tsigKey{"key2.", dns.HmacSHA512, "c2VjcmV0"}, *ls.tsig)
+	}
+
+	parse := func (args string) error {
+		_, err := s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			tsig ` + args + `
+		}`)
+		return err
+	}
+	s.ErrContains(parse(""), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("key1 hmac-sha256"), "Wrong argument count or unexpected line ending")
+	s.ErrContains(parse("key1 hmac-md5 c2VjcmV0"), "unsupported TSIG algorithm")
+	s.ErrContains(parse("key1 hmac-sha256 not-base64!"), "not base64 encoded")
+
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		update_key key1 hmac-sha256 c2VjcmV0
+	}`)
+	s.ErrContains(err, "'update_listen' parameter is required")
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		update_listen :5353
+	}`)
+	s.ErrContains(err, "'update_key' parameter is required")
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		update_listen 5353
+	}`)
+	s.ErrContains(err, "invalid listen address")
+	s.ErrContains(parse(keyFile + ".missing"), "cannot read key file")
+	s.ErrContains(parse(os.DevNull), "key file must contain exactly one key")
+}
+
+func (s *SetupTestSuite) Test_ecs() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.Equal(ednsPolicy{ecsStrip, 24, 56}, ls.edns)
+	}
+
+	parse := func (args string) (LocalStar, error) {
+		return s.parseConfigDefaultZone(`localstar {
+			to_zone corp.net
+			ecs ` + args + `
+		}`)
+	}
+	ls, err = parse("forward")
+	if s.NoError(err) {
+		s.Equal(ednsPolicy{ecsForward, 24, 56}, ls.edns)
+	}
+	ls, err = parse("synthesize")
+	if s.NoError(err) {
+		s.Equal(ednsPolicy{ecsSynthesize, 24, 56}, ls.edns)
+	}
+	ls, err = parse("synthesize 16 48")
+	if s.NoError(err) {
+		s.Equal(ednsPolicy{ecsSynthesize, 16, 48}, ls.edns)
+	}
+	ls, err = parse("synthesize 32")
+	if s.NoError(err) {
+		s.Equal(ednsPolicy{ecsSynthesize, 32, 56}, ls.edns)
+	}
+
+	_, err = parse("")
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = parse("forward 24")
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = parse("synthesize 24 56 0")
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = parse("always")
+	s.ErrContains(err, "unknown ecs mode")
+	_, err = parse("synthesize 33")
+	s.ErrContains(err, "invalid prefix length")
+	_, err = parse("synthesize 24 129")
+	s.ErrContains(err, "invalid prefix length")
+	_, err = parse("synthesize string")
+	s.ErrContains(err, "invalid prefix length")
+}
+
+func (s *SetupTestSuite) Test_ede_extra_text() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.False(ls.edeExtraText)
+	}
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		ede_extra_text
+	}`)
+	if s.NoError(err) {
+		s.True(ls.edeExtraText)
+	}
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		ede_extra_text on
+	}`)
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+}
+
+func (s *SetupTestSuite) Test_health_check() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.Equal(newHealthCheck(), ls.healthCheck)
+		s.Equal(ls.healthCheck, ls.provider.(*compositeDNSProvider).check)
+	}
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		health_check 5s
+	}`)
+	if s.NoError(err) {
+		s.Equal(healthCheck{interval: 5 * time.Second, name: ".", qtype: dns.TypeNS, maxFails: defaultMaxFails}, ls.healthCheck)
+	}
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		health_check 1m probe.corp.net aaaa
+		max_fails 5
+	}`)
+	if s.NoError(err) {
+		s.Equal(healthCheck{interval: time.Minute, name: "probe.corp.net.", qtype: dns.TypeAAAA, maxFails: 5}, ls.healthCheck)
+		s.Equal(ls.healthCheck, ls.provider.(*compositeDNSProvider).check)
+	}
+
+	for conf, msg := range map[string]string{
+		"health_check":                 "Wrong argument count or unexpected line ending",
+		"health_check 1s . NS extra":   "Wrong argument count or unexpected line ending",
+		"health_check often":           `invalid duration: "often"`,
+		"health_check 0s":              "health check interval must be positive",
+		"health_check 1s . BOGUS":      `unknown query type: "BOGUS"`,
+		"max_fails":                    "Wrong argument count or unexpected line ending",
+		"max_fails -1":                 `invalid number: "-1"`,
+	}{
+		_, err = s.parseConfigDefaultZone("localstar {\nto_zone corp.net\n" + conf + "\n}")
+		s.ErrContains(err, msg)
+	}
+}
+
+func (s *SetupTestSuite) Test_hedge() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.False(ls.hedge.enabled())
+	}
+	for conf, expected := range map[string]hedgePolicy{
+		"hedge 50ms":       {delay: 50 * time.Millisecond},
+		"hedge p95":        {percentile: 95},
+		"hedge p99 200ms":  {delay: 200 * time.Millisecond, percentile: 99},
+	}{
+		ls, err = s.parseConfigDefaultZone("localstar {\nto_zone corp.net\n" + conf + "\n}")
+		if s.NoError(err, conf) {
+			s.Equal(expected, ls.hedge, conf)
+			s.Equal(expected, ls.provider.(*compositeDNSProvider).hedge, conf)
+		}
+	}
+	for conf, msg := range map[string]string{
+		"hedge":            "Wrong argument count or unexpected line ending",
+		"hedge 50ms 100ms": "Wrong argument count or unexpected line ending",
+		"hedge soon":       `invalid duration: "soon"`,
+		"hedge 0s":         "hedge delay must be positive",
+		"hedge p0":         `invalid percentile: "p0"`,
+		"hedge p101":       `invalid percentile: "p101"`,
+		"hedge p90 later":  `invalid duration: "later"`,
+	}{
+		_, err = s.parseConfigDefaultZone("localstar {\nto_zone corp.net\n" + conf + "\n}")
+		s.ErrContains(err, msg)
+	}
+}
+
+func (s *SetupTestSuite) Test_attempts() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+	}`)
+	if s.NoError(err) {
+		s.Equal(retryPolicy{attempts: 1}, ls.retry)
+	}
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		endpoint 1.2.3.4
+		timeout 3s
+		attempts 3
+		attempt_timeout 500ms
+	}`)
+	if s.NoError(err) {
+		s.Equal(retryPolicy{attempts: 3, attemptTimeout: 500 * time.Millisecond}, ls.retry)
+		p := ls.provider.(*compositeDNSProvider)
+		s.Equal(ls.retry, p.retry)
+		s.Equal(3 * time.Second, p.timeout)
+		s.Equal(500 * time.Millisecond, p.providers[0].(*simpleDNSProvider).timeout)
+	}
+
+	for conf, msg := range map[string]string{
+		"attempts":             "Wrong argument count or unexpected line ending",
+		"attempts 0":           `invalid number of attempts: "0"`,
+		"attempts many":        `invalid number of attempts: "many"`,
+		"attempt_timeout":      "Wrong argument count or unexpected line ending",
+		"attempt_timeout soon": `invalid duration: "soon"`,
+		"attempt_timeout 0s":   "attempt timeout must be positive",
+	}{
+		_, err = s.parseConfigDefaultZone("localstar {\nto_zone corp.net\n" + conf + "\n}")
+		s.ErrContains(err, msg)
+	}
+}
+
+func (s *SetupTestSuite) Test_tls() {
+	ls, err := s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		endpoint grpc://1.2.3.4
+	}`)
+	if s.NoError(err) {
+		s.Nil(ls.tlsConfig)
+		p := ls.provider.(*compositeDNSProvider)
+		if s.Len(p.providers, 1) && s.IsType(&grpcDNSProvider{}, p.providers[0]) {
+			s.Nil(p.providers[0].(*grpcDNSProvider).tlsConfig)
+		}
+		p.stop()
+	}
+
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		endpoint grpc://1.2.3.4
+		tls_servername dns.corp.net
+		tls
+	}`)
+	if s.NoError(err) && s.NotNil(ls.tlsConfig) {
+		s.Equal("dns.corp.net", ls.tlsConfig.ServerName)
+		p := ls.provider.(*compositeDNSProvider)
+		if s.Len(p.providers, 1) && s.IsType(&grpcDNSProvider{}, p.providers[0]) {
+			s.Equal(ls.tlsConfig, p.providers[0].(*grpcDNSProvider).tlsConfig)
+		}
+		p.stop()
+	}
+
+	ls, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		tls_servername dns.corp.net
+	}`)
+	if s.NoError(err) && s.NotNil(ls.tlsConfig) {
+		s.Equal("dns.corp.net", ls.tlsConfig.ServerName)
+	}
+
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		tls a b c d
+	}`)
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		tls /missing/ca.pem
+	}`)
+	s.ErrContains(err, "invalid tls config")
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		tls_servername
+	}`)
+	s.ErrContains(err, "Wrong argument count or unexpected line ending")
+	_, err = s.parseConfigDefaultZone(`localstar {
+		to_zone corp.net
+		endpoint grpc://1.2.3.4
+		tsig key1 hmac-sha256 c2VjcmV0
+	}`)
+	s.ErrContains(err, "grpc://1.2.3.4:443: tsig is not supported for the transport")
+}
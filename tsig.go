@@ -0,0 +1,111 @@
+package localstar
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const tsigFudge = 300
+
+var (
+	errTsigAlgorithm = errors.New("unsupported TSIG algorithm")
+	errTsigSecret    = errors.New("TSIG secret is not base64 encoded")
+	errTsigKeyFile   = errors.New("key file must contain exactly one key")
+	errTsigUnsigned  = errors.New("response is not TSIG signed")
+)
+
+var tsigAlgorithms = map[string]bool{
+	dns.HmacSHA1:   true,
+	dns.HmacSHA224: true,
+	dns.HmacSHA256: true,
+	dns.HmacSHA384: true,
+	dns.HmacSHA512: true,
+}
+
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    string
+}
+
+func newTsigKey(name, algorithm, secret string) (tsigKey, error) {
+	key := tsigKey{
+		name:      dns.CanonicalName(name),
+		algorithm: dns.CanonicalName(algorithm),
+		secret:    secret,
+	}
+	if !tsigAlgorithms[key.algorithm] {
+		return key, errTsigAlgorithm
+	}
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+		return key, errTsigSecret
+	}
+	return key, nil
+}
+
+// verifyTsig checks the TSIG of a request. The MAC is verified by the
+// server against the original wire bytes, the result is w.TsigStatus().
+func verifyTsig(w dns.ResponseWriter, t *dns.TSIG, key tsigKey) error {
+	if !strings.EqualFold(t.Algorithm, key.algorithm) {
+		return dns.ErrKeyAlg
+	}
+	return w.TsigStatus()
+}
+
+// parseTsigKeyFile parses a key file in BIND format, as generated by
+// tsig-keygen:
+//
+//	key "name" {
+//		algorithm hmac-sha256;
+//		secret "base64";
+//	};
+func parseTsigKeyFile(r io.Reader) (tsigKey, error) {
+	var (
+		tokens []string
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.NewReplacer("{", " { ", "}", " } ", ";", " ; ").Replace(line)
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return tsigKey{}, err
+	}
+
+	var name, algorithm, secret string
+	keys := 0
+	for i := 0; i < len(tokens); i++ {
+		if i+1 >= len(tokens) {
+			break
+		}
+		value := strings.Trim(tokens[i+1], `"`)
+		switch tokens[i] {
+		case "key":
+			name = value
+			keys++
+		case "algorithm":
+			algorithm = value
+		case "secret":
+			secret = value
+		default:
+			continue
+		}
+		i++
+	}
+	if keys != 1 || name == "" || algorithm == "" || secret == "" {
+		return tsigKey{}, errTsigKeyFile
+	}
+	return newTsigKey(name, algorithm, secret)
+}
@@ -0,0 +1,57 @@
+package localstar
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type TsigTestSuite struct {
+	suite.Suite
+}
+
+func TestTsigTestSuite(t *testing.T) {
+	suite.Run(t, new(TsigTestSuite))
+}
+
+func (s *TsigTestSuite) Test_newTsigKey() {
+	key, err := newTsigKey("Key1", "HMAC-SHA256", "c2VjcmV0")
+	s.NoError(err)
+	s.Equal(tsigKey{"key1.", dns.HmacSHA256, "c2VjcmV0"}, key)
+
+	_, err = newTsigKey("key1", "hmac-md5", "c2VjcmV0")
+	s.Equal(errTsigAlgorithm, err)
+	_, err = newTsigKey("key1", "hmac-sha256", "not-base64!")
+	s.Equal(errTsigSecret, err)
+}
+
+func (s *TsigTestSuite) Test_parseTsigKeyFile() {
+	key, err := parseTsigKeyFile(strings.NewReader(`
+# generated by tsig-keygen
+key "upstream-key" {
+	algorithm hmac-sha512;
+	secret "c2VjcmV0"; // base64
+};
+`))
+	s.NoError(err)
+	s.Equal(tsigKey{"upstream-key.", dns.HmacSHA512, "c2VjcmV0"}, key)
+
+	key, err = parseTsigKeyFile(strings.NewReader(`key upstream-key{algorithm hmac-sha256;secret "c2VjcmV0";};`))
+	s.NoError(err)
+	s.Equal(tsigKey{"upstream-key.", dns.HmacSHA256, "c2VjcmV0"}, key)
+
+	for _, content := range []string{
+		``,
+		`key "k1" { algorithm hmac-sha256; };`,
+		`key "k1" { secret "c2VjcmV0"; };`,
+		`key "k1" { algorithm hmac-sha256; secret "c2VjcmV0"; };
+		key "k2" { algorithm hmac-sha256; secret "c2VjcmV0"; };`,
+	}{
+		_, err = parseTsigKeyFile(strings.NewReader(content))
+		s.Equal(errTsigKeyFile, err, content)
+	}
+	_, err = parseTsigKeyFile(strings.NewReader(`key "k1" { algorithm hmac-md5; secret "c2VjcmV0"; };`))
+	s.Equal(errTsigAlgorithm, err)
+}